@@ -0,0 +1,537 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"img-bed/config"
+	"img-bed/handler"
+	"img-bed/middleware"
+	"img-bed/storage"
+)
+
+const usage = `Usage: imgbed [config flags] <command> [flags] [args]
+
+Commands:
+  serve                  start the HTTP server (default)
+  upload <files...>      upload images and print their URLs
+  list                   list images
+  delete <ids...>        delete images
+  stats                  show image count and total size
+  config get             show runtime settings
+  config set key=value   change runtime settings
+  import <dir>           bulk import a directory tree of images
+  backup [-o file]       write a backup archive of the database and images
+  restore <archive>      rebuild an instance from a backup archive
+  fsck                   check storage consistency
+
+Config flags (-config, -port, -auth-token, -upload-dir, -db-path, -base-url,
+-max-size, -enable-compression, -max-width, -jpeg-quality) override the
+config file and environment; run "imgbed -h" for the full list.
+
+Without -server, commands operate directly on DB_PATH and UPLOAD_DIR.
+With -server (or IMGBED_SERVER), they call a running instance using
+-token (or IMGBED_TOKEN, falling back to AUTH_TOKEN).
+`
+
+func runCommand(cfg *config.Config, cmd string, args []string) int {
+	switch cmd {
+	case "serve":
+		return runServe(cfg, args)
+	case "fsck":
+		return runFsck(cfg, args)
+	case "import":
+		return runImport(cfg, args)
+	case "backup":
+		return runBackup(cfg, args)
+	case "restore":
+		return runRestore(cfg, args)
+	case "upload", "list", "delete", "stats", "config":
+		return runClientCommand(cfg, cmd, args)
+	case "help", "-h", "--help":
+		fmt.Print(usage)
+		return 0
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command: %s\n\n%s", cmd, usage)
+		return 2
+	}
+}
+
+// backend 是命令行操作的目标：本地数据库或远程服务
+type backend interface {
+	Upload(path string) (string, error)
+	List(limit, offset int) ([]storage.Image, error)
+	Delete(id string) error
+	Stats() (count, totalSize int64, err error)
+	GetConfig() (*storage.Config, error)
+	UpdateConfig(cfg *storage.Config) error
+	Close() error
+}
+
+func runClientCommand(cfg *config.Config, cmd string, args []string) int {
+	fs := flag.NewFlagSet(cmd, flag.ExitOnError)
+	server := fs.String("server", os.Getenv("IMGBED_SERVER"), "URL of a running imgbed server")
+	token := fs.String("token", firstNonEmpty(os.Getenv("IMGBED_TOKEN"), cfg.AuthToken), "auth token for -server")
+	asJSON := fs.Bool("json", false, "print JSON output")
+	limit := fs.Int("limit", 50, "list: number of images")
+	offset := fs.Int("offset", 0, "list: offset")
+	fs.Parse(args)
+	args = fs.Args()
+
+	var b backend
+	if *server != "" {
+		b = newRemoteBackend(*server, *token)
+	} else {
+		lb, err := newLocalBackend(cfg)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to open database:", err)
+			return 1
+		}
+		b = lb
+	}
+	defer b.Close()
+
+	var err error
+	switch cmd {
+	case "upload":
+		err = cmdUpload(b, args)
+	case "list":
+		err = cmdList(b, *limit, *offset, *asJSON)
+	case "delete":
+		err = cmdDelete(b, args)
+	case "stats":
+		err = cmdStats(b, *asJSON)
+	case "config":
+		err = cmdConfig(b, args)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return 1
+	}
+	return 0
+}
+
+func cmdUpload(b backend, files []string) error {
+	if len(files) == 0 {
+		return errors.New("usage: imgbed upload <files...>")
+	}
+
+	failed := 0
+	for _, path := range files {
+		url, err := b.Upload(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+			failed++
+			continue
+		}
+		fmt.Println(url)
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d uploads failed", failed, len(files))
+	}
+	return nil
+}
+
+func cmdList(b backend, limit, offset int, asJSON bool) error {
+	images, err := b.List(limit, offset)
+	if err != nil {
+		return err
+	}
+
+	if asJSON {
+		return printJSON(images)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tFILENAME\tSIZE\tCREATED\tORIGINAL NAME")
+	for _, img := range images {
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\n", img.ID, img.Filename, img.Size,
+			img.CreatedAt.Local().Format("2006-01-02 15:04"), img.OriginalName)
+	}
+	return w.Flush()
+}
+
+func cmdDelete(b backend, ids []string) error {
+	if len(ids) == 0 {
+		return errors.New("usage: imgbed delete <ids...>")
+	}
+
+	for _, id := range ids {
+		if err := b.Delete(id); err != nil {
+			return fmt.Errorf("%s: %w", id, err)
+		}
+		fmt.Println("deleted", id)
+	}
+	return nil
+}
+
+func cmdStats(b backend, asJSON bool) error {
+	count, size, err := b.Stats()
+	if err != nil {
+		return err
+	}
+
+	if asJSON {
+		return printJSON(map[string]int64{"count": count, "total_size": size})
+	}
+	fmt.Printf("images:     %d\ntotal size: %d bytes\n", count, size)
+	return nil
+}
+
+func cmdConfig(b backend, args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: imgbed config get | imgbed config set key=value...")
+	}
+
+	cfg, err := b.GetConfig()
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "get":
+		return printJSON(cfg)
+	case "set":
+		if len(args) < 2 {
+			return errors.New("usage: imgbed config set key=value...")
+		}
+		for _, kv := range args[1:] {
+			key, value, ok := strings.Cut(kv, "=")
+			if !ok {
+				return fmt.Errorf("invalid setting %q, expected key=value", kv)
+			}
+			if err := cfg.Set(key, value); err != nil {
+				return err
+			}
+		}
+		if err := cfg.Validate(); err != nil {
+			return err
+		}
+		if err := b.UpdateConfig(cfg); err != nil {
+			return err
+		}
+		return printJSON(cfg)
+	default:
+		return fmt.Errorf("unknown config subcommand: %s", args[0])
+	}
+}
+
+// openDB 打开数据库，为旧版本的图片补建 blob 记录，
+// 并把配置中的运行时设置作为初始值写入 config 表
+func openDB(cfg *config.Config) (*storage.DB, error) {
+	db, err := storage.NewDB(cfg.DBPath)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := db.MigrateBlobs(cfg.UploadDir); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	seed := storage.DefaultConfig()
+	seed.EnableCompression = cfg.EnableCompression
+	seed.MaxWidth = cfg.MaxWidth
+	seed.JpegQuality = cfg.JpegQuality
+	seed.MaxSize = cfg.MaxSize
+
+	if err := db.SeedConfig(seed); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+func printJSON(v any) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// detectMimeType 按扩展名判断图片类型，无法判断时根据文件内容嗅探
+func detectMimeType(path string, head []byte) string {
+	if t := mime.TypeByExtension(strings.ToLower(filepath.Ext(path))); t != "" {
+		t, _, _ = strings.Cut(t, ";")
+		return t
+	}
+	return http.DetectContentType(head)
+}
+
+func sniffFile(path string) (*os.File, string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, "", err
+	}
+
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(f, head)
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		f.Close()
+		return nil, "", err
+	}
+	return f, detectMimeType(path, head[:n]), nil
+}
+
+// localBackend 直接操作本地数据库和上传目录
+type localBackend struct {
+	cfg *config.Config
+	db  *storage.DB
+	h   *handler.Handler
+}
+
+// cliActor 是本地命令行操作在审计日志中记录的操作者
+const cliActor = "cli"
+
+func newLocalBackend(cfg *config.Config) (*localBackend, error) {
+	if err := os.MkdirAll(cfg.UploadDir, 0755); err != nil {
+		return nil, err
+	}
+
+	db, err := openDB(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &localBackend{cfg: cfg, db: db, h: handler.New(cfg, db)}, nil
+}
+
+func (b *localBackend) Upload(path string) (string, error) {
+	f, mimeType, err := sniffFile(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	result, err := b.h.Ingest(f, handler.IngestOptions{
+		OriginalName: filepath.Base(path),
+		MimeType:     mimeType,
+		Owner:        middleware.AdminOwner,
+	})
+	if err != nil {
+		return "", err
+	}
+	b.h.Audit(cliActor, "", "image.upload", result.Image.ID, nil, result.Image)
+
+	baseURL := b.cfg.BaseURL
+	if baseURL == "" {
+		baseURL = "http://localhost:" + b.cfg.Port
+	}
+	return fmt.Sprintf("%s/i/%s", baseURL, result.Image.Filename), nil
+}
+
+func (b *localBackend) List(limit, offset int) ([]storage.Image, error) {
+	return b.db.ListImages(storage.ImageFilter{Limit: limit, Offset: offset})
+}
+
+func (b *localBackend) Delete(id string) error {
+	img, err := b.db.GetImage(id)
+	if err != nil || img.DeletedAt != nil {
+		return errors.New("image not found")
+	}
+	if _, err := b.h.RemoveImage(id); err != nil {
+		return err
+	}
+	b.h.Audit(cliActor, "", "image.delete", id, img, nil)
+	return nil
+}
+
+func (b *localBackend) Stats() (int64, int64, error) {
+	count, err := b.db.Count()
+	if err != nil {
+		return 0, 0, err
+	}
+	size, err := b.db.TotalSize()
+	return count, size, err
+}
+
+func (b *localBackend) GetConfig() (*storage.Config, error) {
+	return b.db.GetConfig()
+}
+
+func (b *localBackend) UpdateConfig(cfg *storage.Config) error {
+	before, err := b.db.GetConfig()
+	if err != nil {
+		return err
+	}
+	if err := b.db.UpdateConfig(cfg); err != nil {
+		return err
+	}
+	b.h.Audit(cliActor, "", "config.update", "", before, cfg)
+	return nil
+}
+
+func (b *localBackend) Close() error {
+	return b.db.Close()
+}
+
+// remoteBackend 通过 HTTP API 操作运行中的服务
+type remoteBackend struct {
+	server string
+	token  string
+	client *http.Client
+}
+
+func newRemoteBackend(server, token string) *remoteBackend {
+	return &remoteBackend{
+		server: strings.TrimRight(server, "/"),
+		token:  token,
+		client: &http.Client{Timeout: 5 * time.Minute},
+	}
+}
+
+// sizedReader 是长度已知的请求体，发送时带上 Content-Length
+type sizedReader struct {
+	io.Reader
+	size int64
+}
+
+// do 发送请求并把 JSON 响应解码到 out；非 2xx 响应转换为 error
+func (b *remoteBackend) do(method, path, contentType string, body io.Reader, out any) error {
+	req, err := http.NewRequest(method, b.server+path, body)
+	if err != nil {
+		return err
+	}
+	if sr, ok := body.(*sizedReader); ok {
+		req.ContentLength = sr.size
+	}
+	req.Header.Set("Authorization", "Bearer "+b.token)
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		var e struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(data, &e) == nil && e.Error != "" {
+			return fmt.Errorf("%s (HTTP %d)", e.Error, resp.StatusCode)
+		}
+		return fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(data, out)
+}
+
+func (b *remoteBackend) Upload(path string) (string, error) {
+	f, mimeType, err := sniffFile(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	// 流式发送 multipart 请求体，避免把整个文件读入内存。头部和结尾分隔符
+	// 预先生成，以便带上 Content-Length，服务端可以在接收文件前拒绝超限的上传。
+	var head, tail bytes.Buffer
+	mw := multipart.NewWriter(&head)
+	header := make(textproto.MIMEHeader)
+	header.Set("Content-Disposition", fmt.Sprintf(`form-data; name="file"; filename="%s"`,
+		strings.ReplaceAll(filepath.Base(path), `"`, "")))
+	header.Set("Content-Type", mimeType)
+	if _, err := mw.CreatePart(header); err != nil {
+		return "", err
+	}
+	fmt.Fprintf(&tail, "\r\n--%s--\r\n", mw.Boundary())
+
+	body := &sizedReader{
+		Reader: io.MultiReader(&head, f, &tail),
+		size:   int64(head.Len()) + info.Size() + int64(tail.Len()),
+	}
+
+	var result struct {
+		URL string `json:"url"`
+	}
+	if err := b.do(http.MethodPost, "/api/upload", mw.FormDataContentType(), body, &result); err != nil {
+		return "", err
+	}
+	return result.URL, nil
+}
+
+func (b *remoteBackend) List(limit, offset int) ([]storage.Image, error) {
+	var images []storage.Image
+	q := url.Values{}
+	q.Set("limit", fmt.Sprint(limit))
+	q.Set("offset", fmt.Sprint(offset))
+	err := b.do(http.MethodGet, "/api/images?"+q.Encode(), "", nil, &images)
+	return images, err
+}
+
+func (b *remoteBackend) Delete(id string) error {
+	return b.do(http.MethodDelete, "/api/images/"+url.PathEscape(id), "", nil, nil)
+}
+
+func (b *remoteBackend) Stats() (int64, int64, error) {
+	var stats struct {
+		Count     int64 `json:"count"`
+		TotalSize int64 `json:"total_size"`
+	}
+	err := b.do(http.MethodGet, "/api/stats", "", nil, &stats)
+	return stats.Count, stats.TotalSize, err
+}
+
+func (b *remoteBackend) GetConfig() (*storage.Config, error) {
+	// /api/config 使用 compression_enabled 作为压缩开关的键名
+	var resp struct {
+		storage.Config
+		CompressionEnabled bool `json:"compression_enabled"`
+	}
+	if err := b.do(http.MethodGet, "/api/config", "", nil, &resp); err != nil {
+		return nil, err
+	}
+	cfg := resp.Config
+	cfg.EnableCompression = resp.CompressionEnabled
+	return &cfg, nil
+}
+
+func (b *remoteBackend) UpdateConfig(cfg *storage.Config) error {
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		return err
+	}
+	return b.do(http.MethodPut, "/api/config", "application/json", bytes.NewReader(data), nil)
+}
+
+func (b *remoteBackend) Close() error {
+	return nil
+}
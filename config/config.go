@@ -1,36 +1,265 @@
 package config
 
 import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
 	"os"
 	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
 )
 
+// DefaultFile 是未指定 -config / IMGBED_CONFIG 时自动加载的配置文件（存在时）
+const DefaultFile = "imgbed.yaml"
+
+// Config 按以下优先级合并（后者覆盖前者）：
+//
+//	内置默认值 < 配置文件 < 环境变量 < 命令行参数
+//
+// EnableCompression、MaxWidth、JpegQuality、MaxSize 同时也是运行时配置：
+// 它们只在数据库中尚无对应值时写入 config 表作为初始值，之后以数据库中
+// 的值（可通过 /api/config 或 `imgbed config set` 修改）为准。
 type Config struct {
-	Port       string
-	AuthToken  string
-	UploadDir  string
-	DBPath     string
-	MaxSize    int64
-	BaseURL    string
+	Port      string `yaml:"port"`
+	AuthToken string `yaml:"auth_token"`
+	UploadDir string `yaml:"upload_dir"`
+	DBPath    string `yaml:"db_path"`
+	MaxSize   int64  `yaml:"max_size"`
+	BaseURL   string `yaml:"base_url"`
+	// SigningKey 用于签名私有图片的访问链接，留空时由 AuthToken 派生
+	//（修改 AuthToken 会使已签发的链接失效）
+	SigningKey string `yaml:"signing_key"`
 	// Image compression settings
-	EnableCompression bool
-	MaxWidth          int
-	JpegQuality       int
+	EnableCompression bool `yaml:"enable_compression"`
+	MaxWidth          int  `yaml:"max_width"`
+	JpegQuality       int  `yaml:"jpeg_quality"`
+
+	// ProxyHeader 是反向代理传递客户端 IP 的请求头（如 X-Forwarded-For），
+	// 留空时使用连接的对端地址。只应在服务位于可信代理之后时设置。
+	ProxyHeader string `yaml:"proxy_header"`
+
+	RateLimit RateLimits `yaml:"rate_limit"`
+	AuthBan   AuthBan    `yaml:"auth_ban"`
+
+	// File 是实际加载的配置文件路径，未加载时为空
+	File string `yaml:"-"`
+}
+
+// RateLimit 是令牌桶限流策略：每秒补充 Rate 个令牌，最多积累 Burst 个。
+// Rate 为 0 表示不限流。
+type RateLimit struct {
+	Rate  float64 `yaml:"rate"`
+	Burst int     `yaml:"burst"`
+}
+
+// AuthBan 是认证失败后的自动封禁策略：同一 IP 在 Window 内认证失败
+// Threshold 次后封禁 Duration。Threshold 为 0 表示不自动封禁。
+type AuthBan struct {
+	Threshold int           `yaml:"threshold"`
+	Window    time.Duration `yaml:"window"`
+	Duration  time.Duration `yaml:"duration"`
 }
 
-func Load() *Config {
-	cfg := &Config{
-		Port:              getEnv("PORT", "8080"),
-		AuthToken:         getEnv("AUTH_TOKEN", "changeme"),
-		UploadDir:         getEnv("UPLOAD_DIR", "./data/uploads"),
-		DBPath:            getEnv("DB_PATH", "./data/imgbed.db"),
+// RateLimits 是各类请求的限流策略，只能通过配置文件设置
+type RateLimits struct {
+	Login  RateLimit `yaml:"login"`  // POST /api/login，按 IP
+	Upload RateLimit `yaml:"upload"` // POST /api/upload，按 API 密钥所有者
+	Image  RateLimit `yaml:"image"`  // GET /i/:filename，按 IP
+	// 同一 IP 连续登录失败 LockoutAfter 次后锁定 LockoutDuration，0 表示不锁定
+	LockoutAfter    int           `yaml:"lockout_after"`
+	LockoutDuration time.Duration `yaml:"lockout_duration"`
+}
+
+func defaults() *Config {
+	return &Config{
+		Port:              "8080",
+		AuthToken:         "changeme",
+		UploadDir:         "./data/uploads",
+		DBPath:            "./data/imgbed.db",
 		MaxSize:           50 * 1024 * 1024, // 50MB
-		BaseURL:           getEnv("BASE_URL", ""),
-		EnableCompression: getEnvBool("ENABLE_COMPRESSION", true),
-		MaxWidth:          getEnvInt("MAX_WIDTH", 1920),
-		JpegQuality:       getEnvInt("JPEG_QUALITY", 85),
+		BaseURL:           "",
+		EnableCompression: true,
+		MaxWidth:          1920,
+		JpegQuality:       85,
+		RateLimit: RateLimits{
+			Login:           RateLimit{Rate: 0.2, Burst: 5},
+			Upload:          RateLimit{Rate: 2, Burst: 30},
+			Image:           RateLimit{Rate: 50, Burst: 200},
+			LockoutAfter:    5,
+			LockoutDuration: 15 * time.Minute,
+		},
+		AuthBan: AuthBan{
+			Threshold: 0,
+			Window:    10 * time.Minute,
+			Duration:  time.Hour,
+		},
+	}
+}
+
+// Load 依次应用默认值、配置文件、环境变量和 args 开头的命令行参数，
+// 校验后返回配置以及剩余的参数（子命令及其参数）
+func Load(args []string) (*Config, []string, error) {
+	cfg := defaults()
+
+	path, explicit := configPath(args)
+	if path != "" {
+		if err := cfg.loadFile(path); err != nil {
+			if explicit || !errors.Is(err, os.ErrNotExist) {
+				return nil, nil, err
+			}
+		} else {
+			cfg.File = path
+		}
+	}
+
+	envErr := cfg.loadEnv()
+
+	rest, err := cfg.ParseFlags(args)
+	if err != nil {
+		return nil, nil, err
 	}
-	return cfg
+
+	if err := errors.Join(envErr, cfg.Validate()); err != nil {
+		return nil, nil, err
+	}
+	return cfg, rest, nil
+}
+
+// configPath 返回要加载的配置文件，explicit 表示由用户显式指定（不存在时报错）
+func configPath(args []string) (string, bool) {
+	for i, arg := range args {
+		if !strings.HasPrefix(arg, "-") || arg == "--" {
+			break
+		}
+		name, value, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		if name != "config" {
+			continue
+		}
+		if hasValue {
+			return value, true
+		}
+		if i+1 < len(args) {
+			return args[i+1], true
+		}
+	}
+
+	if v := os.Getenv("IMGBED_CONFIG"); v != "" {
+		return v, true
+	}
+	return DefaultFile, false
+}
+
+func (cfg *Config) loadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("config file %s: %w", path, err)
+	}
+	return nil
+}
+
+func (cfg *Config) loadEnv() error {
+	var errs []error
+	cfg.Port = getEnv("PORT", cfg.Port)
+	cfg.AuthToken = getEnv("AUTH_TOKEN", cfg.AuthToken)
+	cfg.UploadDir = getEnv("UPLOAD_DIR", cfg.UploadDir)
+	cfg.DBPath = getEnv("DB_PATH", cfg.DBPath)
+	cfg.BaseURL = getEnv("BASE_URL", cfg.BaseURL)
+	cfg.ProxyHeader = getEnv("PROXY_HEADER", cfg.ProxyHeader)
+	cfg.SigningKey = getEnv("SIGNING_KEY", cfg.SigningKey)
+	cfg.MaxSize = getEnvInt64("MAX_SIZE", cfg.MaxSize, &errs)
+	cfg.EnableCompression = getEnvBool("ENABLE_COMPRESSION", cfg.EnableCompression, &errs)
+	cfg.MaxWidth = getEnvInt("MAX_WIDTH", cfg.MaxWidth, &errs)
+	cfg.JpegQuality = getEnvInt("JPEG_QUALITY", cfg.JpegQuality, &errs)
+	return errors.Join(errs...)
+}
+
+// ParseFlags 用命令行参数覆盖配置，遇到第一个非参数（子命令）时停止，
+// 返回剩余参数。未出现的参数保持当前值。
+func (cfg *Config) ParseFlags(args []string) ([]string, error) {
+	fs := flag.NewFlagSet("imgbed", flag.ContinueOnError)
+	fs.String("config", cfg.File, "path to YAML config file (env IMGBED_CONFIG)")
+	fs.StringVar(&cfg.Port, "port", cfg.Port, "HTTP port (env PORT)")
+	fs.StringVar(&cfg.AuthToken, "auth-token", cfg.AuthToken, "admin token (env AUTH_TOKEN)")
+	fs.StringVar(&cfg.UploadDir, "upload-dir", cfg.UploadDir, "image storage directory (env UPLOAD_DIR)")
+	fs.StringVar(&cfg.DBPath, "db-path", cfg.DBPath, "SQLite database path (env DB_PATH)")
+	fs.StringVar(&cfg.BaseURL, "base-url", cfg.BaseURL, "public URL prefix for image links (env BASE_URL)")
+	fs.StringVar(&cfg.SigningKey, "signing-key", cfg.SigningKey, "secret for signed private image URLs (env SIGNING_KEY)")
+	fs.StringVar(&cfg.ProxyHeader, "proxy-header", cfg.ProxyHeader, "header carrying the client IP behind a reverse proxy (env PROXY_HEADER)")
+	fs.Int64Var(&cfg.MaxSize, "max-size", cfg.MaxSize, "initial max upload size in bytes (env MAX_SIZE)")
+	fs.BoolVar(&cfg.EnableCompression, "enable-compression", cfg.EnableCompression, "initial compression setting (env ENABLE_COMPRESSION)")
+	fs.IntVar(&cfg.MaxWidth, "max-width", cfg.MaxWidth, "initial max image width (env MAX_WIDTH)")
+	fs.IntVar(&cfg.JpegQuality, "jpeg-quality", cfg.JpegQuality, "initial JPEG quality (env JPEG_QUALITY)")
+
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	return fs.Args(), nil
+}
+
+// Validate 检查配置是否合法，返回包含所有问题的错误
+func (cfg *Config) Validate() error {
+	var errs []error
+
+	if port, err := strconv.Atoi(cfg.Port); err != nil || port < 1 || port > 65535 {
+		errs = append(errs, fmt.Errorf("port must be a number between 1 and 65535, got %q", cfg.Port))
+	}
+	if cfg.AuthToken == "" {
+		errs = append(errs, errors.New("auth_token must not be empty"))
+	}
+	if cfg.UploadDir == "" {
+		errs = append(errs, errors.New("upload_dir must not be empty"))
+	}
+	if cfg.DBPath == "" {
+		errs = append(errs, errors.New("db_path must not be empty"))
+	}
+	if cfg.BaseURL != "" {
+		u, err := url.Parse(cfg.BaseURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("base_url must be an http(s) URL, got %q", cfg.BaseURL))
+		}
+		cfg.BaseURL = strings.TrimRight(cfg.BaseURL, "/")
+	}
+	if cfg.MaxSize < 1024*1024 || cfg.MaxSize > 100*1024*1024 {
+		errs = append(errs, errors.New("max_size must be between 1MB and 100MB"))
+	}
+	if cfg.MaxWidth < 100 || cfg.MaxWidth > 10000 {
+		errs = append(errs, errors.New("max_width must be between 100 and 10000"))
+	}
+	if cfg.JpegQuality < 1 || cfg.JpegQuality > 100 {
+		errs = append(errs, errors.New("jpeg_quality must be between 1 and 100"))
+	}
+	for name, rl := range map[string]RateLimit{
+		"login":  cfg.RateLimit.Login,
+		"upload": cfg.RateLimit.Upload,
+		"image":  cfg.RateLimit.Image,
+	} {
+		if rl.Rate < 0 || (rl.Rate > 0 && rl.Burst < 1) {
+			errs = append(errs, fmt.Errorf("rate_limit.%s: rate must not be negative and burst must be at least 1", name))
+		}
+	}
+	if cfg.RateLimit.LockoutAfter < 0 || cfg.RateLimit.LockoutDuration < 0 {
+		errs = append(errs, errors.New("rate_limit.lockout_after and lockout_duration must not be negative"))
+	}
+	if cfg.AuthBan.Threshold < 0 {
+		errs = append(errs, errors.New("auth_ban.threshold must not be negative"))
+	}
+	if cfg.AuthBan.Threshold > 0 && (cfg.AuthBan.Window <= 0 || cfg.AuthBan.Duration <= 0) {
+		errs = append(errs, errors.New("auth_ban.window and auth_ban.duration must be positive when auth_ban.threshold is set"))
+	}
+
+	return errors.Join(errs...)
 }
 
 func getEnv(key, fallback string) string {
@@ -40,22 +269,35 @@ func getEnv(key, fallback string) string {
 	return fallback
 }
 
-func getEnvBool(key string, fallback bool) bool {
+func getEnvBool(key string, fallback bool, errs *[]error) bool {
 	if v := os.Getenv(key); v != "" {
 		b, err := strconv.ParseBool(v)
 		if err == nil {
 			return b
 		}
+		*errs = append(*errs, fmt.Errorf("%s: invalid boolean %q", key, v))
 	}
 	return fallback
 }
 
-func getEnvInt(key string, fallback int) int {
+func getEnvInt(key string, fallback int, errs *[]error) int {
 	if v := os.Getenv(key); v != "" {
 		i, err := strconv.Atoi(v)
 		if err == nil {
 			return i
 		}
+		*errs = append(*errs, fmt.Errorf("%s: invalid integer %q", key, v))
+	}
+	return fallback
+}
+
+func getEnvInt64(key string, fallback int64, errs *[]error) int64 {
+	if v := os.Getenv(key); v != "" {
+		i, err := strconv.ParseInt(v, 10, 64)
+		if err == nil {
+			return i
+		}
+		*errs = append(*errs, fmt.Errorf("%s: invalid integer %q", key, v))
 	}
 	return fallback
 }
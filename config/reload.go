@@ -0,0 +1,92 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Change 描述重新加载配置时一个字段的变化
+type Change struct {
+	Field string
+	Old   string
+	New   string
+}
+
+func (c Change) String() string {
+	return fmt.Sprintf("%s: %s -> %s", c.Field, c.Old, c.New)
+}
+
+// restartOnly 中的字段在运行期间无法替换，修改后需要重启才会生效
+var restartOnly = map[string]bool{
+	"port":         true,
+	"upload_dir":   true,
+	"db_path":      true,
+	"proxy_header": true,
+}
+
+// RequiresRestart 报告字段修改后是否需要重启服务
+func RequiresRestart(field string) bool {
+	return restartOnly[field]
+}
+
+// seedOnly 中的字段只是运行时配置的初始值，之后以数据库中的值为准
+var seedOnly = map[string]bool{
+	"max_size":           true,
+	"enable_compression": true,
+	"max_width":          true,
+	"jpeg_quality":       true,
+}
+
+// RuntimeSeed 报告字段是否只是运行时配置的初始值。这些字段的修改不会生效，
+// 需要通过管理面板或 `imgbed config set` 修改数据库中的值。
+func RuntimeSeed(field string) bool {
+	return seedOnly[field]
+}
+
+// Diff 返回 old 到 new 之间变化的字段。令牌只显示掩码，不会写入日志。
+func Diff(old, new *Config) []Change {
+	fields := []struct {
+		name     string
+		old, new any
+	}{
+		{"port", old.Port, new.Port},
+		{"auth_token", maskToken(old.AuthToken), maskToken(new.AuthToken)},
+		{"upload_dir", old.UploadDir, new.UploadDir},
+		{"db_path", old.DBPath, new.DBPath},
+		{"max_size", old.MaxSize, new.MaxSize},
+		{"base_url", old.BaseURL, new.BaseURL},
+		{"signing_key", maskToken(old.SigningKey), maskToken(new.SigningKey)},
+		{"enable_compression", old.EnableCompression, new.EnableCompression},
+		{"max_width", old.MaxWidth, new.MaxWidth},
+		{"jpeg_quality", old.JpegQuality, new.JpegQuality},
+		{"proxy_header", old.ProxyHeader, new.ProxyHeader},
+		{"rate_limit.login", old.RateLimit.Login, new.RateLimit.Login},
+		{"rate_limit.upload", old.RateLimit.Upload, new.RateLimit.Upload},
+		{"rate_limit.image", old.RateLimit.Image, new.RateLimit.Image},
+		{"rate_limit.lockout_after", old.RateLimit.LockoutAfter, new.RateLimit.LockoutAfter},
+		{"rate_limit.lockout_duration", old.RateLimit.LockoutDuration, new.RateLimit.LockoutDuration},
+		{"auth_ban.threshold", old.AuthBan.Threshold, new.AuthBan.Threshold},
+		{"auth_ban.window", old.AuthBan.Window, new.AuthBan.Window},
+		{"auth_ban.duration", old.AuthBan.Duration, new.AuthBan.Duration},
+	}
+
+	var changes []Change
+	for _, f := range fields {
+		o, n := fmt.Sprint(f.old), fmt.Sprint(f.new)
+		if o == n && ((f.name == "auth_token" && old.AuthToken != new.AuthToken) ||
+			(f.name == "signing_key" && old.SigningKey != new.SigningKey)) {
+			n += " (changed)"
+		}
+		if o != n {
+			changes = append(changes, Change{Field: f.name, Old: o, New: n})
+		}
+	}
+	return changes
+}
+
+func maskToken(token string) string {
+	if len(token) <= 4 {
+		return strings.Repeat("*", len(token))
+	}
+	return token[:2] + strings.Repeat("*", len(token)-4) + token[len(token)-2:]
+}
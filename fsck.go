@@ -0,0 +1,65 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+
+	"img-bed/config"
+	"img-bed/storage"
+)
+
+// runFsck 实现 `imgbed fsck` 子命令，返回进程退出码：
+// 0 表示一致（或所有问题均已修复），1 表示仍有未修复的问题。
+func runFsck(cfg *config.Config, args []string) int {
+	fs := flag.NewFlagSet("fsck", flag.ExitOnError)
+	importOrphans := fs.Bool("import-orphans", false, "create records for files without rows")
+	removeDangling := fs.Bool("remove-dangling", false, "remove rows whose file is missing and fix reference counts")
+	recompute := fs.Bool("recompute-hashes", false, "update recorded hashes and sizes from file contents")
+	repair := fs.Bool("repair", false, "enable all repairs")
+	fs.Parse(args)
+
+	db, err := openDB(cfg)
+	if err != nil {
+		log.Fatal("Failed to open database:", err)
+	}
+	defer db.Close()
+
+	opts := storage.FsckOptions{
+		ImportOrphans:   *importOrphans || *repair,
+		RemoveDangling:  *removeDangling || *repair,
+		RecomputeHashes: *recompute || *repair,
+	}
+
+	report, err := db.Fsck(cfg.UploadDir, opts)
+	if err != nil {
+		log.Fatal("fsck failed:", err)
+	}
+
+	for _, issue := range report.Issues {
+		status := "found"
+		if issue.Repaired {
+			status = "repaired"
+		}
+		target := issue.Filename
+		if target == "" {
+			target = issue.ImageID
+		}
+		if target == "" {
+			target = issue.Hash
+		}
+		line := fmt.Sprintf("%-9s %-18s %s", status, issue.Kind, target)
+		if issue.Detail != "" {
+			line += " (" + issue.Detail + ")"
+		}
+		fmt.Println(line)
+	}
+
+	fmt.Printf("\nScanned %d files, %d blobs: %d issues, %d unresolved\n",
+		report.FilesScanned, report.BlobsScanned, len(report.Issues), report.Unresolved())
+
+	if report.Unresolved() > 0 {
+		return 1
+	}
+	return 0
+}
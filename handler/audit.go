@@ -0,0 +1,81 @@
+package handler
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+
+	"img-bed/middleware"
+	"img-bed/storage"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Audit 写入一条审计记录。before / after 序列化为 JSON 保存，为 nil 时不记录。
+// 审计失败只记录日志，不影响操作本身。
+func (h *Handler) Audit(actor, ip, action, target string, before, after any) {
+	entry := &storage.AuditEntry{
+		Actor:  actor,
+		IP:     ip,
+		Action: action,
+		Target: target,
+		Before: auditJSON(before),
+		After:  auditJSON(after),
+	}
+	if err := h.db.AddAudit(entry); err != nil {
+		log.Printf("Failed to write audit log (%s %s): %v", action, target, err)
+	}
+}
+
+// audit 以当前请求的所有者和 IP 写入审计记录
+func (h *Handler) audit(c *fiber.Ctx, action, target string, before, after any) {
+	h.Audit(middleware.Owner(c), c.IP(), action, target, before, after)
+}
+
+func auditJSON(v any) json.RawMessage {
+	if v == nil {
+		return nil
+	}
+	data, err := json.Marshal(v)
+	if err != nil || string(data) == "null" {
+		return nil
+	}
+	return data
+}
+
+// ListAudit 查询审计日志，支持按 actor、action、target 和时间范围
+// （since / until，RFC3339）过滤，使用 limit / offset 分页
+func (h *Handler) ListAudit(c *fiber.Ctx) error {
+	filter := storage.AuditFilter{
+		Actor:  c.Query("actor"),
+		Action: c.Query("action"),
+		Target: c.Query("target"),
+		Limit:  c.QueryInt("limit", 50),
+		Offset: c.QueryInt("offset", 0),
+	}
+
+	if filter.Limit > 100 {
+		filter.Limit = 100
+	}
+
+	for name, t := range map[string]*time.Time{"since": &filter.Since, "until": &filter.Until} {
+		if v := c.Query(name); v != "" {
+			parsed, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return c.Status(400).JSON(fiber.Map{"error": name + " must be an RFC3339 time"})
+			}
+			*t = parsed
+		}
+	}
+
+	entries, err := h.db.ListAudit(filter)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "failed to list audit log"})
+	}
+
+	if entries == nil {
+		entries = []storage.AuditEntry{}
+	}
+
+	return c.JSON(entries)
+}
@@ -0,0 +1,151 @@
+package handler
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"img-bed/middleware"
+	"img-bed/storage"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// maxBulkIDs 是单次批量操作允许的最大图片数
+const maxBulkIDs = 1000
+
+// bulkAuditActions 是批量操作写入审计日志时使用的动作名，与单个操作一致
+var bulkAuditActions = map[string]string{
+	storage.BulkDelete:     "image.delete",
+	storage.BulkRestore:    "image.restore",
+	storage.BulkVisibility: "image.visibility",
+	storage.BulkTag:        "image.tag",
+	storage.BulkAlbum:      "image.album",
+}
+
+// 标签和相册名的最大长度
+const (
+	maxTagLen   = 32
+	maxAlbumLen = 64
+)
+
+// Bulk 在一个事务中对多张图片执行 delete、restore、tag（添加标签）、
+// album（移入相册）或 visibility，返回每张图片的结果。API 密钥用户只能
+// 操作自己的图片。
+func (h *Handler) Bulk(c *fiber.Ctx) error {
+	var req struct {
+		Action     string   `json:"action"`
+		IDs        []string `json:"ids"`
+		Visibility string   `json:"visibility"`
+		Tags       []string `json:"tags"`
+		Album      string   `json:"album"`
+	}
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "invalid request"})
+	}
+
+	switch req.Action {
+	case storage.BulkDelete, storage.BulkRestore:
+	case storage.BulkVisibility:
+		if !validVisibility(req.Visibility) {
+			return c.Status(400).JSON(fiber.Map{"error": "visibility must be public or private"})
+		}
+	case storage.BulkTag:
+		if len(req.Tags) == 0 {
+			return c.Status(400).JSON(fiber.Map{"error": "tags must not be empty"})
+		}
+		for _, tag := range req.Tags {
+			if !validTag(tag) {
+				return c.Status(400).JSON(fiber.Map{"error": fmt.Sprintf("tags must be 1-%d characters without commas", maxTagLen)})
+			}
+		}
+	case storage.BulkAlbum:
+		if len(req.Album) > maxAlbumLen {
+			return c.Status(400).JSON(fiber.Map{"error": fmt.Sprintf("album must be at most %d characters", maxAlbumLen)})
+		}
+	default:
+		return c.Status(400).JSON(fiber.Map{"error": "action must be one of delete, restore, tag, album, visibility"})
+	}
+
+	if len(req.IDs) == 0 {
+		return c.Status(400).JSON(fiber.Map{"error": "ids must not be empty"})
+	}
+	if len(req.IDs) > maxBulkIDs {
+		return c.Status(400).JSON(fiber.Map{"error": fmt.Sprintf("at most %d ids per request", maxBulkIDs)})
+	}
+
+	cfg, err := h.db.GetConfig()
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "failed to load config"})
+	}
+
+	bulk := storage.BulkRequest{
+		Action:     req.Action,
+		IDs:        req.IDs,
+		Trash:      cfg.TrashRetentionDays > 0,
+		Visibility: req.Visibility,
+		Tags:       req.Tags,
+		Album:      req.Album,
+	}
+	if !middleware.IsAdmin(c) {
+		bulk.Owner = middleware.Owner(c)
+	}
+
+	items, orphans, err := h.db.Bulk(bulk)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "bulk operation failed"})
+	}
+
+	uploadDir := h.Config().UploadDir
+	for _, orphan := range orphans {
+		os.Remove(filepath.Join(uploadDir, orphan.Filename))
+	}
+
+	succeeded := 0
+	for _, item := range items {
+		if !item.Success {
+			continue
+		}
+		succeeded++
+
+		var after any
+		updated := *item.Image
+		switch req.Action {
+		case storage.BulkVisibility:
+			updated.Visibility = req.Visibility
+			after = &updated
+		case storage.BulkTag:
+			updated.Tags = mergeTags(updated.Tags, req.Tags)
+			after = &updated
+		case storage.BulkAlbum:
+			updated.Album = req.Album
+			after = &updated
+		}
+		h.audit(c, bulkAuditActions[req.Action], item.ID, item.Image, after)
+	}
+
+	return c.JSON(fiber.Map{
+		"action":    req.Action,
+		"succeeded": succeeded,
+		"failed":    len(items) - succeeded,
+		"results":   items,
+	})
+}
+
+// validTag 报告 tag 是否为合法的标签：非空、不超过 maxTagLen 且不含逗号
+func validTag(tag string) bool {
+	return tag != "" && len(tag) <= maxTagLen && strings.TrimSpace(tag) == tag && !strings.Contains(tag, ",")
+}
+
+// mergeTags 返回 tags 加上 added 中尚未出现的标签
+func mergeTags(tags, added []string) []string {
+	merged := append([]string{}, tags...)
+	for _, tag := range added {
+		if !slices.Contains(merged, tag) {
+			merged = append(merged, tag)
+		}
+	}
+	return merged
+}
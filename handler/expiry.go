@@ -0,0 +1,62 @@
+package handler
+
+import (
+	"errors"
+	"time"
+
+	"img-bed/middleware"
+	"img-bed/storage"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// maxUploadTTL 是上传时可以指定的最长有效期
+const maxUploadTTL = 365 * 24 * time.Hour
+
+// maxViewsLimit 是上传时 max_views 的上限
+const maxViewsLimit = 1000000
+
+// parseTTL 解析图片有效期，如 30m、24h
+func parseTTL(s string) (time.Duration, error) {
+	ttl, err := time.ParseDuration(s)
+	if err != nil || ttl < time.Minute || ttl > maxUploadTTL {
+		return 0, errors.New("ttl must be a duration between 1m and 8760h")
+	}
+	return ttl, nil
+}
+
+// uploadTTL 返回本次上传的有效期：请求中的 ttl 优先，其次是 API 密钥的
+// default_ttl；都没有时返回 0，表示永久保存
+func (h *Handler) uploadTTL(c *fiber.Ctx, ttl string) (time.Duration, error) {
+	if ttl == "" {
+		if id := middleware.KeyID(c); id != "" {
+			if key, err := h.db.GetAPIKeyByID(id); err == nil {
+				ttl = key.DefaultTTL
+			}
+		}
+	}
+	if ttl == "" {
+		return 0, nil
+	}
+	return parseTTL(ttl)
+}
+
+// expired 报告图片是否已过期
+func expired(img *storage.Image) bool {
+	return img.ExpiresAt != nil && !time.Now().Before(*img.ExpiresAt)
+}
+
+// exhausted 报告图片的访问次数是否已达到 max_views
+func exhausted(img *storage.Image) bool {
+	return img.MaxViews > 0 && img.Views >= img.MaxViews
+}
+
+// capExpiry 把缓存或链接的有效期限制在图片过期之前
+func capExpiry(img *storage.Image, d time.Duration) time.Duration {
+	if img.ExpiresAt != nil {
+		if remaining := time.Until(*img.ExpiresAt); remaining < d {
+			return remaining
+		}
+	}
+	return d
+}
@@ -0,0 +1,107 @@
+package handler
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"img-bed/storage"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// exportRecord 是导出清单中的一行
+type exportRecord struct {
+	storage.Image
+	URL string `json:"url"`
+}
+
+var exportCSVHeader = []string{
+	"id", "url", "filename", "original_name", "hash", "size",
+	"width", "height", "mime_type", "owner", "visibility", "created_at",
+}
+
+// Export 流式导出所有图片的清单（format=json 或 csv），逐行读取数据库，
+// 不会把整张表读入内存
+func (h *Handler) Export(c *fiber.Ctx) error {
+	format := c.Query("format", "json")
+	if format != "json" && format != "csv" {
+		return c.Status(400).JSON(fiber.Map{"error": "format must be json or csv"})
+	}
+
+	// 请求上下文在流式写入时不可再用，提前取出链接前缀
+	baseURL := h.baseURL(c)
+	name := "imgbed-export-" + time.Now().Format("20060102-150405") + "." + format
+
+	if format == "csv" {
+		c.Set("Content-Type", "text/csv; charset=utf-8")
+	} else {
+		c.Set("Content-Type", "application/json")
+	}
+	c.Set("Content-Disposition", `attachment; filename="`+name+`"`)
+
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		var err error
+		if format == "csv" {
+			err = h.exportCSV(w, baseURL)
+		} else {
+			err = h.exportJSON(w, baseURL)
+		}
+		if err != nil {
+			// 响应头已发送，只能记录错误
+			log.Println("Export failed:", err)
+		}
+		w.Flush()
+	})
+	return nil
+}
+
+func (h *Handler) exportJSON(w *bufio.Writer, baseURL string) error {
+	w.WriteString("[")
+	first := true
+	err := h.db.EachImage(func(img *storage.Image) error {
+		data, err := json.Marshal(exportRecord{Image: *img, URL: fmt.Sprintf("%s/i/%s", baseURL, img.Filename)})
+		if err != nil {
+			return err
+		}
+		if !first {
+			w.WriteString(",")
+		}
+		first = false
+		w.WriteString("\n")
+		_, err = w.Write(data)
+		return err
+	})
+	w.WriteString("\n]\n")
+	return err
+}
+
+func (h *Handler) exportCSV(w *bufio.Writer, baseURL string) error {
+	cw := csv.NewWriter(w)
+	cw.Write(exportCSVHeader)
+	err := h.db.EachImage(func(img *storage.Image) error {
+		return cw.Write([]string{
+			img.ID,
+			fmt.Sprintf("%s/i/%s", baseURL, img.Filename),
+			img.Filename,
+			img.OriginalName,
+			img.Hash,
+			strconv.FormatInt(img.Size, 10),
+			strconv.Itoa(img.Width),
+			strconv.Itoa(img.Height),
+			img.MimeType,
+			img.Owner,
+			img.Visibility,
+			img.CreatedAt.UTC().Format(time.RFC3339),
+		})
+	})
+	cw.Flush()
+	if err != nil {
+		return err
+	}
+	return cw.Error()
+}
@@ -1,20 +1,28 @@
 package handler
 
 import (
-	"crypto/rand"
+	"bufio"
+	"bytes"
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"image"
+	"image/color"
 	"image/jpeg"
 	"image/png"
 	"io"
+	"log"
+	"mime/multipart"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"img-bed/config"
+	"img-bed/middleware"
 	"img-bed/storage"
 
 	"github.com/disintegration/imaging"
@@ -22,152 +30,230 @@ import (
 )
 
 type Handler struct {
-	cfg *config.Config
+	cfg atomic.Pointer[config.Config]
 	db  *storage.DB
+
+	// lockout 记录各 IP 连续登录失败的次数
+	lockout *middleware.Lockout
+	// failureLimit 限制每个 IP 写入认证失败记录的速率
+	failureLimit *middleware.Limiter
+	bans         banList
+	// hotlink 是按所有者设置的防盗链规则
+	hotlink hotlinkRules
+	// views 累计尚未写入数据库的访问统计
+	views viewStats
 }
 
 func New(cfg *config.Config, db *storage.DB) *Handler {
-	return &Handler{cfg: cfg, db: db}
+	h := &Handler{db: db}
+	h.cfg.Store(cfg)
+	h.lockout = middleware.NewLockout(func() (int, time.Duration) {
+		rl := h.Config().RateLimit
+		return rl.LockoutAfter, rl.LockoutDuration
+	})
+	h.failureLimit = middleware.NewLimiter(func() (float64, int) {
+		return authFailureRate, authFailureBurst
+	})
+	h.bans.load(db)
+	h.hotlink.load(db)
+	return h
 }
 
-var allowedMimes = map[string]string{
-	"image/jpeg": ".jpg",
-	"image/png":  ".png",
-	"image/gif":  ".gif",
-	"image/webp": ".webp",
-	"image/svg+xml": ".svg",
+// Config 返回当前生效的配置。配置可能被热重载替换，
+// 同一请求内需要多次读取时应先保存返回值。
+func (h *Handler) Config() *config.Config {
+	return h.cfg.Load()
 }
 
+// SetConfig 原子地替换当前配置，之后的请求使用新配置
+func (h *Handler) SetConfig(cfg *config.Config) {
+	h.cfg.Store(cfg)
+}
+
+// multipartOverhead 是 multipart 请求中除文件内容外（分隔符、头部、表单字段）
+// 允许的额外字节数
+const multipartOverhead = 64 * 1024
+
+// BodyLimit 返回当前允许的请求体大小：运行时 max_size 加上 multipart 开销
+func (h *Handler) BodyLimit() int64 {
+	maxSize := h.Config().MaxSize // fallback to env config
+	if cfg, err := h.db.GetConfig(); err == nil && cfg.MaxSize > 0 {
+		maxSize = cfg.MaxSize
+	}
+	return maxSize + multipartOverhead
+}
+
+// Upload 流式解析 multipart 请求体：文件内容边读边写入临时文件，
+// 超过 max_size 时立即中止并返回 413，不会先把整个请求体读完。
+// 表单字段（如 near_duplicate）需要位于文件之前。
 func (h *Handler) Upload(c *fiber.Ctx) error {
-	file, err := c.FormFile("file")
-	if err != nil {
+	boundary := string(c.Request().Header.MultipartFormBoundary())
+	if boundary == "" {
 		return c.Status(400).JSON(fiber.Map{"error": "no file provided"})
 	}
 
-	// Get max size from database config
-	cfg, err := h.db.GetConfig()
-	maxSize := h.cfg.MaxSize // fallback to env config
-	if err == nil && cfg.MaxSize > 0 {
-		maxSize = cfg.MaxSize
+	maxSize := h.BodyLimit() - multipartOverhead
+
+	fields := map[string]string{}
+	mr := multipart.NewReader(requestBody(c), boundary)
+	var part *multipart.Part
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			return c.Status(400).JSON(fiber.Map{"error": "no file provided"})
+		}
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "invalid multipart body"})
+		}
+		if p.FormName() == "file" && p.FileName() != "" {
+			part = p
+			break
+		}
+		value, _ := io.ReadAll(io.LimitReader(p, 1024))
+		fields[p.FormName()] = string(value)
 	}
 
-	if file.Size > maxSize {
-		return c.Status(400).JSON(fiber.Map{"error": "file too large"})
+	formValue := func(key string) string {
+		if v, ok := fields[key]; ok {
+			return v
+		}
+		return c.Query(key)
 	}
 
-	contentType := file.Header.Get("Content-Type")
-	ext, ok := allowedMimes[contentType]
-	if !ok {
-		return c.Status(400).JSON(fiber.Map{"error": "unsupported file type"})
+	visibility := formValue("visibility")
+	if visibility != "" && !validVisibility(visibility) {
+		return c.Status(400).JSON(fiber.Map{"error": "visibility must be public or private"})
 	}
 
-	// 打开文件计算 hash
-	src, err := file.Open()
+	ttl, err := h.uploadTTL(c, formValue("ttl"))
 	if err != nil {
-		return c.Status(500).JSON(fiber.Map{"error": "failed to read file"})
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
 	}
-	defer src.Close()
 
-	// 计算 SHA256 hash
-	hasher := sha256.New()
-	if _, err := io.Copy(hasher, src); err != nil {
-		return c.Status(500).JSON(fiber.Map{"error": "failed to calculate hash"})
-	}
-	fileHash := hex.EncodeToString(hasher.Sum(nil))
-
-	// 检查是否已存在相同 hash 的文件
-	existingImg, err := h.db.GetImageByHash(fileHash)
-	if err == nil && existingImg != nil {
-		// 文件已存在，直接返回现有的 URL
-		baseURL := h.cfg.BaseURL
-		if baseURL == "" {
-			baseURL = c.Protocol() + "://" + c.Hostname()
+	var maxViews int64
+	if v := formValue("max_views"); v != "" {
+		maxViews, err = strconv.ParseInt(v, 10, 64)
+		if err != nil || maxViews < 0 || maxViews > maxViewsLimit {
+			return c.Status(400).JSON(fiber.Map{"error": fmt.Sprintf("max_views must be between 0 and %d", maxViewsLimit)})
 		}
-
-		return c.JSON(fiber.Map{
-			"id":            existingImg.ID,
-			"url":           fmt.Sprintf("%s/i/%s", baseURL, existingImg.Filename),
-			"filename":      existingImg.Filename,
-			"original_name": file.Filename,
-			"hash":          fileHash,
-			"size":          file.Size,
-			"duplicate":     true,
-		})
 	}
 
-	// 重新打开文件进行保存
-	src, err = file.Open()
-	if err != nil {
-		return c.Status(500).JSON(fiber.Map{"error": "failed to read file"})
+	// 未指定 threshold 时使用默认值，threshold=0 只匹配感知哈希完全相同的图片
+	threshold := defaultSimilarThreshold
+	if v := formValue("threshold"); v != "" {
+		threshold, err = strconv.Atoi(v)
+		if err != nil || threshold < 0 || threshold > 64 {
+			return c.Status(400).JSON(fiber.Map{"error": "threshold must be between 0 and 64"})
+		}
 	}
-	defer src.Close()
 
-	id := generateID()
-	filename := id + ext
+	// 可选的近似重复检测：near_duplicate=warn 在响应中附带相似图片，
+	// near_duplicate=reject 在存在相似图片时拒绝上传。API 密钥用户只与
+	// 自己的图片比较
+	similarOwner := ""
+	if !middleware.IsAdmin(c) {
+		similarOwner = middleware.Owner(c)
+	}
+
+	result, err := h.Ingest(&limitReader{r: part, n: maxSize}, IngestOptions{
+		OriginalName:  part.FileName(),
+		MimeType:      part.Header.Get("Content-Type"),
+		Owner:         middleware.Owner(c),
+		NearDuplicate: formValue("near_duplicate"),
+		Threshold:     threshold,
+		SimilarOwner:  similarOwner,
+		Visibility:    visibility,
+		TTL:           ttl,
+		MaxViews:      maxViews,
+	})
+	var quotaErr *storage.QuotaError
+	switch {
+	case errors.As(err, &quotaErr):
+		return quotaExceeded(c, quotaErr)
+	case err == ErrTooLarge:
+		c.Context().SetConnectionClose()
+		return c.Status(413).JSON(fiber.Map{"error": err.Error()})
+	case err == ErrUnsupportedType:
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	case err == ErrNearDuplicate:
+		return c.Status(409).JSON(fiber.Map{
+			"error":   err.Error(),
+			"similar": result.Similar,
+		})
+	case err != nil:
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
 
-	// Save to temporary file first
-	tmpPath := filepath.Join(h.cfg.UploadDir, ".tmp_"+filename)
-	dstPath := filepath.Join(h.cfg.UploadDir, filename)
+	img := result.Image
+	h.audit(c, "image.upload", img.ID, nil, img)
 
-	tmpFile, err := os.Create(tmpPath)
-	if err != nil {
-		return c.Status(500).JSON(fiber.Map{"error": "failed to save file"})
+	resp := fiber.Map{
+		"id":            img.ID,
+		"url":           h.imageURL(c, img.Filename),
+		"filename":      img.Filename,
+		"original_name": img.OriginalName,
+		"hash":          img.Hash,
+		"size":          img.Size,
+		"visibility":    img.Visibility,
+		"duplicate":     result.Duplicate,
 	}
-
-	if _, err := io.Copy(tmpFile, src); err != nil {
-		tmpFile.Close()
-		os.Remove(tmpPath)
-		return c.Status(500).JSON(fiber.Map{"error": "failed to save file"})
+	if img.ExpiresAt != nil {
+		resp["expires_at"] = img.ExpiresAt
 	}
-	tmpFile.Close()
-
-	// Compress/process the image
-	if err := h.compressImage(tmpPath, dstPath, contentType); err != nil {
-		os.Remove(tmpPath)
-		os.Remove(dstPath)
-		return c.Status(500).JSON(fiber.Map{"error": "failed to process image"})
+	if img.MaxViews > 0 {
+		resp["max_views"] = img.MaxViews
+	}
+	// 私有图片的直链无法访问，附带一个默认有效期的签名链接
+	if img.Visibility == storage.VisibilityPrivate {
+		resp["signed_url"] = h.signedURL(c, img.Filename, time.Now().Add(capExpiry(img, defaultSignTTL)).Truncate(time.Second))
+	}
+	if len(result.Similar) > 0 {
+		resp["similar"] = result.Similar
 	}
 
-	// Remove temporary file
-	os.Remove(tmpPath)
+	return c.JSON(resp)
+}
 
-	// Get actual file size after compression
-	fileInfo, err := os.Stat(dstPath)
-	if err != nil {
-		os.Remove(dstPath)
-		return c.Status(500).JSON(fiber.Map{"error": "failed to get file info"})
+// requestBody 返回请求体的读取流。分块传输的请求体已被 BodyLimit 读入内存。
+func requestBody(c *fiber.Ctx) io.Reader {
+	if stream := c.Context().RequestBodyStream(); stream != nil {
+		return stream
 	}
-	actualSize := fileInfo.Size()
+	return bytes.NewReader(c.Body())
+}
 
-	img := &storage.Image{
-		ID:           id,
-		Filename:     filename,
-		OriginalName: file.Filename,
-		Hash:         fileHash,
-		Size:         actualSize,
-		MimeType:     contentType,
-		CreatedAt:    time.Now(),
-	}
+// limitReader 最多读取 n 字节，超出时返回 ErrTooLarge
+type limitReader struct {
+	r io.Reader
+	n int64
+}
 
-	if err := h.db.SaveImage(img); err != nil {
-		os.Remove(dstPath)
-		return c.Status(500).JSON(fiber.Map{"error": "failed to save metadata"})
+func (l *limitReader) Read(p []byte) (int, error) {
+	if l.n < 0 {
+		return 0, ErrTooLarge
 	}
-
-	baseURL := h.cfg.BaseURL
-	if baseURL == "" {
-		baseURL = c.Protocol() + "://" + c.Hostname()
+	if int64(len(p)) > l.n+1 {
+		p = p[:l.n+1]
+	}
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	if l.n < 0 {
+		return n, ErrTooLarge
 	}
+	return n, err
+}
 
-	return c.JSON(fiber.Map{
-		"id":            id,
-		"url":           fmt.Sprintf("%s/i/%s", baseURL, filename),
-		"filename":      filename,
-		"original_name": file.Filename,
-		"hash":          fileHash,
-		"size":          actualSize,
-		"duplicate":     false,
-	})
+// imageURL 返回图片的公开链接
+func (h *Handler) imageURL(c *fiber.Ctx, filename string) string {
+	return fmt.Sprintf("%s/i/%s", h.baseURL(c), filename)
+}
+
+// baseURL 返回公开链接前缀，未配置 BASE_URL 时使用请求的主机名
+func (h *Handler) baseURL(c *fiber.Ctx) string {
+	if baseURL := h.Config().BaseURL; baseURL != "" {
+		return baseURL
+	}
+	return c.Protocol() + "://" + c.Hostname()
 }
 
 func (h *Handler) GetImage(c *fiber.Ctx) error {
@@ -181,14 +267,85 @@ func (h *Handler) GetImage(c *fiber.Ctx) error {
 		return c.Status(400).JSON(fiber.Map{"error": "invalid filename"})
 	}
 
-	filePath := filepath.Join(h.cfg.UploadDir, filename)
+	img, err := h.db.GetImageByFilename(filename)
+	if err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "image not found"})
+	}
+
+	filePath := filepath.Join(h.Config().UploadDir, img.BlobFile)
 
 	if _, err := os.Stat(filePath); os.IsNotExist(err) {
 		return c.Status(404).JSON(fiber.Map{"error": "image not found"})
 	}
 
-	c.Set("Cache-Control", "public, max-age=31536000")
-	return c.SendFile(filePath)
+	// 已过期或访问次数已用完、但尚未被后台任务删除的图片
+	if expired(img) {
+		return c.Status(410).JSON(fiber.Map{"error": "image expired"})
+	}
+	if exhausted(img) {
+		return c.Status(410).JSON(fiber.Map{"error": "image view limit reached"})
+	}
+
+	// 管理面板的预览链接本身就是访问授权，不计入访问次数和统计，
+	// 否则浏览图库就会消耗限制访问次数的图片
+	if c.Query("preview") != "" {
+		if _, ok := h.verifySignature(c, filename, true); !ok {
+			return c.Status(403).JSON(fiber.Map{"error": "invalid or expired signature"})
+		}
+		c.Set("Cache-Control", "private, no-store")
+		return c.SendFile(filePath)
+	}
+
+	var cacheControl string
+	if img.Visibility == storage.VisibilityPrivate {
+		// 私有图片需要有效的签名链接，且只允许在链接有效期内缓存
+		remaining, ok := h.verifySignature(c, filename, false)
+		if !ok {
+			return c.Status(403).JSON(fiber.Map{"error": "invalid or expired signature"})
+		}
+		cacheControl = fmt.Sprintf("private, max-age=%d", int(capExpiry(img, remaining).Seconds()))
+	} else {
+		// 防盗链只作用于公开图片，私有图片的签名链接本身就是访问授权
+		cfg, err := h.hotlinkConfig(img.Owner)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "failed to load config"})
+		}
+		if cfg.HotlinkProtection {
+			// 响应内容取决于来源，共享缓存需要按来源区分
+			c.Vary(fiber.HeaderOrigin, fiber.HeaderReferer)
+			if !h.allowHotlink(c, cfg) {
+				return rejectHotlink(c, cfg)
+			}
+		}
+
+		// 会过期的图片只允许缓存到过期时间
+		maxAge := capExpiry(img, 365*24*time.Hour)
+		cacheControl = fmt.Sprintf("public, max-age=%d", int(maxAge.Seconds()))
+	}
+
+	// 限制访问次数的图片立即计数，计数与上限检查在同一条语句中完成，
+	// 并发访问不会超过 max_views；其他图片的访问次数随统计批量写入
+	if img.MaxViews > 0 && c.Method() == fiber.MethodGet {
+		ok, err := h.db.RecordView(img.ID)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "failed to record view"})
+		}
+		if !ok {
+			return c.Status(410).JSON(fiber.Map{"error": "image view limit reached"})
+		}
+	}
+
+	// 限制访问次数的图片不能被缓存，否则缓存命中的访问不会被计数
+	if img.MaxViews > 0 {
+		cacheControl = "no-store"
+	}
+
+	c.Set("Cache-Control", cacheControl)
+	if err := c.SendFile(filePath); err != nil {
+		return err
+	}
+	h.recordServed(c, img, img.MaxViews > 0)
+	return nil
 }
 
 func (h *Handler) List(c *fiber.Ctx) error {
@@ -199,19 +356,48 @@ func (h *Handler) List(c *fiber.Ctx) error {
 		limit = 100
 	}
 
-	images, err := h.db.ListImages(limit, offset)
+	// API 密钥用户只能看到自己的图片，也只能拿到自己图片的签名链接
+	owner := ""
+	if !middleware.IsAdmin(c) {
+		owner = middleware.Owner(c)
+	}
+
+	images, err := h.db.ListImages(storage.ImageFilter{
+		Owner:  owner,
+		Tag:    c.Query("tag"),
+		Album:  c.Query("album"),
+		Limit:  limit,
+		Offset: offset,
+	})
 	if err != nil {
 		return c.Status(500).JSON(fiber.Map{"error": "failed to list images"})
 	}
 
-	if images == nil {
-		images = []storage.Image{}
+	listed := make([]listedImage, len(images))
+	for i, img := range images {
+		listed[i].Image = img
+		expires := time.Now().Add(capExpiry(&img, defaultSignTTL)).Truncate(time.Second)
+		if img.Visibility == storage.VisibilityPrivate {
+			listed[i].SignedURL = h.signedURL(c, img.Filename, expires)
+		}
+		if img.MaxViews > 0 {
+			listed[i].PreviewURL = h.previewURL(c, img.Filename, expires)
+		}
 	}
 
-	return c.JSON(images)
+	return c.JSON(listed)
 }
 
-func (h *Handler) Delete(c *fiber.Ctx) error {
+// listedImage 是图片列表中的一项。私有图片的直链无法访问，附带一个默认
+// 有效期的签名链接；限制访问次数的图片附带一个不计入访问次数的预览链接，
+// 供管理面板显示
+type listedImage struct {
+	storage.Image
+	SignedURL  string `json:"signed_url,omitempty"`
+	PreviewURL string `json:"preview_url,omitempty"`
+}
+
+func (h *Handler) Similar(c *fiber.Ctx) error {
 	id := c.Params("id")
 	if id == "" {
 		return c.Status(400).JSON(fiber.Map{"error": "missing id"})
@@ -222,17 +408,110 @@ func (h *Handler) Delete(c *fiber.Ctx) error {
 		return c.Status(404).JSON(fiber.Map{"error": "image not found"})
 	}
 
-	filePath := filepath.Join(h.cfg.UploadDir, img.Filename)
-	os.Remove(filePath)
+	// API 密钥用户只能查询自己的图片，结果中也只包含自己的图片
+	owner := ""
+	if !middleware.IsAdmin(c) {
+		owner = middleware.Owner(c)
+		if img.Owner != owner {
+			return c.Status(403).JSON(fiber.Map{"error": "not the owner of this image"})
+		}
+	}
+
+	blob, err := h.db.GetBlob(img.BlobHash)
+	if err != nil || blob.PHash == "" {
+		return c.JSON([]storage.SimilarImage{})
+	}
+
+	threshold := c.QueryInt("threshold", defaultSimilarThreshold)
+	if threshold < 0 || threshold > 64 {
+		return c.Status(400).JSON(fiber.Map{"error": "threshold must be between 0 and 64"})
+	}
+
+	limit := c.QueryInt("limit", 20)
+	if limit > 100 {
+		limit = 100
+	}
+
+	similar, err := h.db.FindSimilar(blob.PHash, threshold, limit, id, owner)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "failed to find similar images"})
+	}
+
+	if similar == nil {
+		similar = []storage.SimilarImage{}
+	}
+
+	return c.JSON(similar)
+}
+
+func (h *Handler) Delete(c *fiber.Ctx) error {
+	id := c.Params("id")
+	if id == "" {
+		return c.Status(400).JSON(fiber.Map{"error": "missing id"})
+	}
+
+	img, err := h.db.GetImage(id)
+	if err != nil || img.DeletedAt != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "image not found"})
+	}
+
+	// API 密钥用户只能删除自己上传的图片
+	if !middleware.IsAdmin(c) && img.Owner != middleware.Owner(c) {
+		return c.Status(403).JSON(fiber.Map{"error": "not the owner of this image"})
+	}
 
-	if err := h.db.DeleteImage(id); err != nil {
+	trashed, err := h.RemoveImage(id)
+	if err != nil {
 		return c.Status(500).JSON(fiber.Map{"error": "failed to delete"})
 	}
+	h.audit(c, "image.delete", id, img, nil)
 
-	return c.JSON(fiber.Map{"success": true})
+	return c.JSON(fiber.Map{"success": true, "trashed": trashed})
+}
+
+// Fsck 检查上传目录与数据库的一致性。GET 只报告问题，
+// POST 可通过请求体中的 FsckOptions 指定修复方式。
+func (h *Handler) Fsck(c *fiber.Ctx) error {
+	var opts storage.FsckOptions
+	if c.Method() == fiber.MethodPost && len(c.Body()) > 0 {
+		if err := c.BodyParser(&opts); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "invalid request"})
+		}
+	}
+
+	report, err := h.db.Fsck(h.Config().UploadDir, opts)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "failed to check storage"})
+	}
+	if opts.ImportOrphans || opts.RemoveDangling || opts.RecomputeHashes {
+		h.audit(c, "storage.fsck", "", nil, opts)
+	}
+
+	return c.JSON(report)
+}
+
+// Backup 以流的形式返回完整备份归档（与 `imgbed backup` 相同）
+func (h *Handler) Backup(c *fiber.Ctx) error {
+	name := "imgbed-backup-" + time.Now().Format("20060102-150405") + ".tar.gz"
+	c.Set("Content-Type", "application/gzip")
+	c.Set("Content-Disposition", `attachment; filename="`+name+`"`)
+
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		if _, err := h.db.Backup(w, h.Config().UploadDir); err != nil {
+			// 响应头已发送，只能记录错误并截断归档
+			log.Println("Backup failed:", err)
+		}
+		w.Flush()
+	})
+	return nil
 }
 
+// Login 校验令牌。同一 IP 连续失败过多时暂时锁定，锁定期间直接返回 429。
 func (h *Handler) Login(c *fiber.Ctx) error {
+	if locked, wait := h.lockout.Locked(c.IP()); locked {
+		return middleware.TooManyRequests(c, wait)
+	}
+
 	var req struct {
 		Token string `json:"token"`
 	}
@@ -241,13 +520,21 @@ func (h *Handler) Login(c *fiber.Ctx) error {
 		return c.Status(400).JSON(fiber.Map{"error": "invalid request"})
 	}
 
-	if req.Token != h.cfg.AuthToken {
-		return c.Status(401).JSON(fiber.Map{"error": "invalid token"})
+	owner := middleware.AdminOwner
+	if !middleware.TokenEqual(req.Token, h.Config().AuthToken) {
+		var ok bool
+		if owner, _, ok = h.LookupAPIKey(req.Token); !ok {
+			h.TokenFailed(c, "invalid login token")
+			return c.Status(401).JSON(fiber.Map{"error": "invalid token"})
+		}
 	}
+	h.lockout.Reset(c.IP())
+	h.Audit(owner, c.IP(), "auth.login", owner, nil, nil)
 
 	return c.JSON(fiber.Map{
 		"success": true,
 		"token":   req.Token,
+		"owner":   owner,
 	})
 }
 
@@ -255,9 +542,23 @@ func (h *Handler) Stats(c *fiber.Ctx) error {
 	count, _ := h.db.Count()
 	size, _ := h.db.TotalSize()
 
+	// 先写入内存中的增量，与 ImageStats、TopImages 的数字保持一致
+	h.FlushStats()
+	hits, served, _ := h.db.TotalServed()
+
+	// 当前用户的使用量和配额（未设置配额时为 null）
+	owner := middleware.Owner(c)
+	usage, _ := h.db.GetUsage(owner)
+	quota, _ := h.db.GetQuota(owner)
+
 	return c.JSON(fiber.Map{
 		"count":      count,
 		"total_size": size,
+		"hits":       hits,
+		"bytes_sent": served,
+		"owner":      owner,
+		"usage":      usage,
+		"quota":      quota,
 	})
 }
 
@@ -268,122 +569,133 @@ func (h *Handler) GetConfig(c *fiber.Ctx) error {
 	}
 
 	return c.JSON(fiber.Map{
-		"compression_enabled": cfg.EnableCompression,
-		"max_width":           cfg.MaxWidth,
-		"jpeg_quality":        cfg.JpegQuality,
-		"max_size":            cfg.MaxSize,
+		"compression_enabled":  cfg.EnableCompression,
+		"max_width":            cfg.MaxWidth,
+		"max_height":           cfg.MaxHeight,
+		"jpeg_quality":         cfg.JpegQuality,
+		"png_compression":      cfg.PngCompression,
+		"output_format":        cfg.OutputFormat,
+		"max_size":             cfg.MaxSize,
+		"allowed_types":        cfg.AllowedTypes,
+		"retention_days":       cfg.RetentionDays,
+		"default_visibility":   cfg.DefaultVisibility,
+		"trash_retention_days": cfg.TrashRetentionDays,
+		"hotlink_protection":   cfg.HotlinkProtection,
+		"hotlink_referers":     cfg.HotlinkReferers,
+		"hotlink_allow_empty":  cfg.HotlinkAllowEmpty,
+		"hotlink_action":       cfg.HotlinkAction,
 	})
 }
 
+// UpdateConfig 修改运行时配置，请求中未出现的字段保持原值
 func (h *Handler) UpdateConfig(c *fiber.Ctx) error {
-	var req storage.Config
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(400).JSON(fiber.Map{"error": "invalid request"})
+	before, err := h.db.GetConfig()
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "failed to load config"})
 	}
-
-	// 验证参数
-	if req.MaxWidth < 100 || req.MaxWidth > 10000 {
-		return c.Status(400).JSON(fiber.Map{"error": "max_width must be between 100 and 10000"})
+	// GetConfig 每次返回新的副本，修改 req 不会影响 before
+	req, err := h.db.GetConfig()
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "failed to load config"})
 	}
-
-	if req.JpegQuality < 1 || req.JpegQuality > 100 {
-		return c.Status(400).JSON(fiber.Map{"error": "jpeg_quality must be between 1 and 100"})
+	if err := c.BodyParser(req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "invalid request"})
 	}
 
-	if req.MaxSize < 1024*1024 || req.MaxSize > 100*1024*1024 {
-		return c.Status(400).JSON(fiber.Map{"error": "max_size must be between 1MB and 100MB"})
+	// 验证参数
+	if err := req.Validate(); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
 	}
 
-	if err := h.db.UpdateConfig(&req); err != nil {
+	if err := h.db.UpdateConfig(req); err != nil {
 		return c.Status(500).JSON(fiber.Map{"error": "failed to update config"})
 	}
+	h.audit(c, "config.update", "", before, req)
 
 	return c.JSON(fiber.Map{"success": true})
 }
 
-func generateID() string {
-	b := make([]byte, 6)
-	rand.Read(b)
-	return hex.EncodeToString(b)
-}
-
-// compressImage compresses and resizes the image if compression is enabled
-func (h *Handler) compressImage(srcPath, dstPath, mimeType string) error {
-	// Load config from database
-	cfg, err := h.db.GetConfig()
-	if err != nil || !cfg.EnableCompression {
-		// If compression is disabled or error, just copy the file
-		src, err := os.Open(srcPath)
-		if err != nil {
-			return err
-		}
-		defer src.Close()
-
-		dst, err := os.Create(dstPath)
-		if err != nil {
-			return err
-		}
-		defer dst.Close()
-
-		_, err = io.Copy(dst, src)
-		return err
-	}
-
+// compressImage compresses and resizes the image if compression is enabled,
+// converting it to dstMime (see storage.Config.OutputType), and returns the
+// SHA256 of the bytes written to dstPath along with the perceptual hash of
+// the image. When no re-encoding is needed the source file is committed into
+// place and srcHash is returned. dstPath only ever appears fully written and
+// fsynced.
+func compressImage(cfg *storage.Config, srcPath, dstPath, srcMime, dstMime, srcHash string) (string, string, error) {
 	// Skip compression for GIF and SVG (preserve animation and vector format)
-	if mimeType == "image/gif" || mimeType == "image/svg+xml" {
-		src, err := os.Open(srcPath)
-		if err != nil {
-			return err
-		}
-		defer src.Close()
-
-		dst, err := os.Create(dstPath)
-		if err != nil {
-			return err
-		}
-		defer dst.Close()
-
-		_, err = io.Copy(dst, src)
-		return err
+	if !cfg.EnableCompression || srcMime == "image/gif" || srcMime == "image/svg+xml" {
+		phash := dHashFile(srcPath)
+		return srcHash, phash, storage.CommitFile(srcPath, dstPath)
 	}
 
 	// Open and decode the image
 	src, err := os.Open(srcPath)
 	if err != nil {
-		return err
+		return "", "", err
 	}
 	defer src.Close()
 
 	img, _, err := image.Decode(src)
 	if err != nil {
-		return err
+		return "", "", err
 	}
+	phash := dHash(img)
 
-	// Resize if width exceeds max width
+	// Resize to fit within max width and (optional) max height
 	bounds := img.Bounds()
-	width := bounds.Dx()
-	if width > cfg.MaxWidth {
-		img = imaging.Resize(img, cfg.MaxWidth, 0, imaging.Lanczos)
+	maxHeight := cfg.MaxHeight
+	if maxHeight == 0 {
+		maxHeight = bounds.Dy()
+	}
+	if bounds.Dx() > cfg.MaxWidth || bounds.Dy() > maxHeight {
+		img = imaging.Fit(img, cfg.MaxWidth, maxHeight, imaging.Lanczos)
 	}
 
-	// Create output file
-	dst, err := os.Create(dstPath)
+	// Encode into a temporary file, then commit it into place
+	outPath := filepath.Join(filepath.Dir(dstPath), storage.TempPrefix+"out_"+filepath.Base(dstPath))
+	dst, err := os.Create(outPath)
 	if err != nil {
-		return err
+		return "", "", err
 	}
-	defer dst.Close()
+
+	hasher := sha256.New()
+	w := io.MultiWriter(dst, hasher)
 
 	// Encode with compression based on format
-	switch mimeType {
+	switch dstMime {
 	case "image/jpeg":
-		return jpeg.Encode(dst, img, &jpeg.Options{Quality: cfg.JpegQuality})
+		if srcMime != "image/jpeg" {
+			// JPEG 不支持透明通道，转换时铺白底
+			bg := imaging.New(img.Bounds().Dx(), img.Bounds().Dy(), color.White)
+			img = imaging.Overlay(bg, img, image.Pt(0, 0), 1.0)
+		}
+		err = jpeg.Encode(w, img, &jpeg.Options{Quality: cfg.JpegQuality})
 	case "image/png":
 		// PNG doesn't have quality setting, but re-encoding removes metadata
-		return png.Encode(dst, img)
+		enc := png.Encoder{CompressionLevel: pngCompressionLevels[cfg.PngCompression]}
+		err = enc.Encode(w, img)
 	case "image/webp":
 		// For WebP, just re-encode (removes metadata)
-		return png.Encode(dst, img)
+		err = png.Encode(w, img)
 	default:
-		return fmt.Errorf("unsupported format for compression: %s", mimeType)
+		err = fmt.Errorf("unsupported format for compression: %s", dstMime)
+	}
+	if cerr := dst.Close(); err == nil {
+		err = cerr
 	}
+	if err == nil {
+		err = storage.CommitFile(outPath, dstPath)
+	}
+	if err != nil {
+		os.Remove(outPath)
+		return "", "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), phash, nil
+}
+
+var pngCompressionLevels = map[string]png.CompressionLevel{
+	"default": png.DefaultCompression,
+	"none":    png.NoCompression,
+	"speed":   png.BestSpeed,
+	"best":    png.BestCompression,
 }
@@ -0,0 +1,183 @@
+package handler
+
+import (
+	"log"
+	"net/url"
+	"sync"
+
+	"img-bed/storage"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// hotlinkPlaceholder 是 hotlink_action 为 placeholder 时返回的占位图
+const hotlinkPlaceholder = `<svg xmlns="http://www.w3.org/2000/svg" width="320" height="80" viewBox="0 0 320 80">` +
+	`<rect width="320" height="80" fill="#eeeeee"/>` +
+	`<text x="160" y="46" font-family="sans-serif" font-size="16" fill="#888888" text-anchor="middle">Image hotlinking not allowed</text>` +
+	`</svg>`
+
+// allowHotlink 按防盗链配置检查请求来源。优先使用 Origin，其次是 Referer；
+// 本站（请求的主机名和 BASE_URL）始终允许。
+func (h *Handler) allowHotlink(c *fiber.Ctx, cfg *storage.Config) bool {
+	source := c.Get(fiber.HeaderOrigin)
+	if source == "" || source == "null" {
+		source = c.Get(fiber.HeaderReferer)
+	}
+	if source == "" {
+		return cfg.HotlinkAllowEmpty
+	}
+
+	u, err := url.Parse(source)
+	if err != nil || u.Hostname() == "" {
+		return false
+	}
+	host := u.Hostname()
+
+	if self, err := url.Parse("//" + c.Hostname()); err == nil && host == self.Hostname() {
+		return true
+	}
+	if base, err := url.Parse(h.Config().BaseURL); err == nil && host == base.Hostname() {
+		return true
+	}
+	return cfg.AllowsReferer(host)
+}
+
+// rejectHotlink 拒绝不在白名单中的来源，按配置返回 403 或占位图
+func rejectHotlink(c *fiber.Ctx, cfg *storage.Config) error {
+	c.Set("Cache-Control", "no-store")
+	if cfg.HotlinkAction == "placeholder" {
+		c.Set(fiber.HeaderContentType, "image/svg+xml")
+		return c.Status(200).SendString(hotlinkPlaceholder)
+	}
+	return c.Status(403).JSON(fiber.Map{"error": "hotlinking not allowed"})
+}
+
+// hotlinkRules 是 hotlink_rules 表在内存中的副本，每次访问公开图片都要检查
+type hotlinkRules struct {
+	mu    sync.RWMutex
+	rules map[string]storage.HotlinkRule
+}
+
+func (r *hotlinkRules) load(db *storage.DB) {
+	rules, err := db.ListHotlinkRules()
+	if err != nil {
+		log.Println("Failed to load hotlink rules:", err)
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.rules = make(map[string]storage.HotlinkRule, len(rules))
+	for _, rule := range rules {
+		r.rules[rule.Owner] = rule
+	}
+}
+
+func (r *hotlinkRules) get(owner string) (storage.HotlinkRule, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	rule, ok := r.rules[owner]
+	return rule, ok
+}
+
+func (r *hotlinkRules) set(rule storage.HotlinkRule) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.rules == nil {
+		r.rules = make(map[string]storage.HotlinkRule)
+	}
+	r.rules[rule.Owner] = rule
+}
+
+func (r *hotlinkRules) remove(owner string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.rules, owner)
+}
+
+// hotlinkConfig 返回 owner 的图片适用的防盗链配置：有单独规则时覆盖全局设置
+func (h *Handler) hotlinkConfig(owner string) (*storage.Config, error) {
+	cfg, err := h.db.GetConfig()
+	if err != nil {
+		return nil, err
+	}
+	if rule, ok := h.hotlink.get(owner); ok {
+		rule.Apply(cfg)
+	}
+	return cfg, nil
+}
+
+func (h *Handler) ListHotlinkRules(c *fiber.Ctx) error {
+	rules, err := h.db.ListHotlinkRules()
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "failed to list hotlink rules"})
+	}
+
+	if rules == nil {
+		rules = []storage.HotlinkRule{}
+	}
+
+	return c.JSON(rules)
+}
+
+// SetHotlinkRule 为用户单独设置防盗链，未出现的字段使用当前的全局设置
+func (h *Handler) SetHotlinkRule(c *fiber.Ctx) error {
+	owner := c.Params("owner")
+	if err := validOwner(owner); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	cfg, err := h.db.GetConfig()
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "failed to load config"})
+	}
+
+	var before *storage.HotlinkRule
+	req := storage.HotlinkRule{
+		Protection: cfg.HotlinkProtection,
+		Referers:   cfg.HotlinkReferers,
+		AllowEmpty: cfg.HotlinkAllowEmpty,
+		Action:     cfg.HotlinkAction,
+	}
+	if rule, ok := h.hotlink.get(owner); ok {
+		before = &rule
+		req = rule
+	}
+	// 解析 JSON 会复用切片的底层数组，复制一份以免修改缓存中的规则
+	req.Referers = append([]string{}, req.Referers...)
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "invalid request"})
+	}
+	req.Owner = owner
+	if req.Referers == nil {
+		req.Referers = []string{}
+	}
+	if err := req.Validate(); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	if err := h.db.SetHotlinkRule(&req); err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "failed to set hotlink rule"})
+	}
+	h.hotlink.set(req)
+	h.audit(c, "hotlink.set", owner, before, req)
+
+	return c.JSON(req)
+}
+
+// DeleteHotlinkRule 删除用户的防盗链规则，之后该用户的图片使用全局设置
+func (h *Handler) DeleteHotlinkRule(c *fiber.Ctx) error {
+	owner := c.Params("owner")
+	var before any
+	if rule, ok := h.hotlink.get(owner); ok {
+		before = rule
+	}
+
+	if err := h.db.DeleteHotlinkRule(owner); err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "failed to delete hotlink rule"})
+	}
+	h.hotlink.remove(owner)
+	h.audit(c, "hotlink.delete", owner, before, nil)
+
+	return c.JSON(fiber.Map{"success": true})
+}
@@ -0,0 +1,292 @@
+package handler
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"image"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"img-bed/storage"
+)
+
+var (
+	ErrUnsupportedType = errors.New("unsupported file type")
+	ErrNearDuplicate   = errors.New("near-duplicate image exists")
+	ErrTooLarge        = errors.New("file too large")
+
+	errSaveFile     = errors.New("failed to save file")
+	errProcessImage = errors.New("failed to process image")
+	errFileInfo     = errors.New("failed to get file info")
+	errSaveMetadata = errors.New("failed to save metadata")
+	errLoadConfig   = errors.New("failed to load config")
+)
+
+// IngestOptions 描述一次图片写入
+type IngestOptions struct {
+	OriginalName string
+	MimeType     string
+	Owner        string
+	CreatedAt    time.Time // 为零值时使用当前时间
+	// NearDuplicate 为 "warn" 时在结果中返回相似图片，为 "reject" 时
+	// 存在相似图片则返回 ErrNearDuplicate。Threshold 是允许的最大汉明距离，
+	// 0 表示感知哈希完全相同
+	NearDuplicate string
+	Threshold     int
+	// SimilarOwner 不为空时近似重复检测只在该所有者的图片中查找，
+	// 非管理员不能借此看到其他所有者的图片
+	SimilarOwner string
+	// KeepOriginal 为 true 时跳过压缩，按原样保存文件
+	KeepOriginal bool
+	// Visibility 为空时使用运行时配置 default_visibility
+	Visibility string
+	// TTL 大于 0 时图片在 CreatedAt + TTL 之后过期
+	TTL time.Duration
+	// MaxViews 大于 0 时图片被访问该次数后失效
+	MaxViews int64
+	// Hash 不为空时是调用方已计算的原始内容 SHA256，写入时不再重复计算
+	Hash string
+}
+
+// IngestResult 是 Ingest 的结果。Duplicate 表示内容与已有 blob 相同，
+// 本次上传只增加了引用。
+type IngestResult struct {
+	Image     *storage.Image
+	Duplicate bool
+	Similar   []storage.SimilarImage
+}
+
+// Ingest 把 r 中的图片写入 UploadDir 并登记到数据库。HTTP 上传与命令行
+// 上传、导入共用这一流程：单次读取计算 hash，按原始内容和处理后内容去重，
+// 文件落盘后再提交数据库记录。超出所有者配额时返回 *storage.QuotaError。
+func (h *Handler) Ingest(r io.Reader, opts IngestOptions) (*IngestResult, error) {
+	cfg, err := h.db.GetConfig()
+	if err != nil {
+		return nil, errLoadConfig
+	}
+	if _, ok := storage.MimeExtensions[opts.MimeType]; !ok || !cfg.Allows(opts.MimeType) {
+		return nil, ErrUnsupportedType
+	}
+
+	// 输出格式策略可能改变保存的文件类型
+	outMime := opts.MimeType
+	if cfg.EnableCompression && !opts.KeepOriginal {
+		outMime = cfg.OutputType(opts.MimeType)
+	}
+
+	// 先按当前使用量检查配额，避免已满的用户上传后才被拒绝；
+	// 最终检查在 SaveImage 的事务中进行
+	if err := h.db.CheckQuota(opts.Owner, 0); err != nil {
+		return nil, err
+	}
+
+	id := storage.NewID()
+	filename := id + storage.MimeExtensions[outMime]
+
+	uploadDir := h.Config().UploadDir
+	tmpPath := filepath.Join(uploadDir, storage.TempPrefix+filename)
+	dstPath := filepath.Join(uploadDir, filename)
+
+	tmpFile, err := os.Create(tmpPath)
+	if err != nil {
+		return nil, errSaveFile
+	}
+
+	// 单次读取：同时写入临时文件并计算 SHA256 hash
+	hasher := sha256.New()
+	w := io.MultiWriter(tmpFile, hasher)
+	if opts.Hash != "" {
+		w = tmpFile
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		tmpFile.Close()
+		os.Remove(tmpPath)
+		if errors.Is(err, ErrTooLarge) {
+			return nil, ErrTooLarge
+		}
+		return nil, errSaveFile
+	}
+	tmpFile.Close()
+	fileHash := opts.Hash
+	if fileHash == "" {
+		fileHash = hex.EncodeToString(hasher.Sum(nil))
+	}
+
+	createdAt := opts.CreatedAt
+	if createdAt.IsZero() {
+		createdAt = time.Now()
+	}
+
+	img := &storage.Image{
+		ID:           id,
+		Filename:     filename,
+		OriginalName: opts.OriginalName,
+		Hash:         fileHash,
+		Owner:        opts.Owner,
+		Visibility:   opts.Visibility,
+		MaxViews:     opts.MaxViews,
+		CreatedAt:    createdAt,
+	}
+	if img.Visibility == "" {
+		img.Visibility = cfg.DefaultVisibility
+	}
+	if opts.TTL > 0 {
+		expiresAt := createdAt.Add(opts.TTL)
+		img.ExpiresAt = &expiresAt
+	}
+
+	// 临时文件保留到提交数据库记录之后：沿用的 blob 被并发删除时需要重新写入
+	defer os.Remove(tmpPath) // no-op once committed into place
+
+	// fresh 是本次上传写入 dstPath 的新 blob，去重命中原始内容时为 nil
+	var fresh *storage.Blob
+
+	// 检查是否已存在相同原始内容的 blob，在解码/编码之前完成去重
+	blob, err := h.db.GetBlobBySourceHash(fileHash)
+	if err != nil {
+		fresh, err = storeBlob(cfg, tmpPath, dstPath, fileHash, outMime, opts)
+		if err != nil {
+			return nil, err
+		}
+
+		// 处理后的内容可能与已有 blob 相同（例如上传的是已压缩过的图片）
+		if blob, err = h.db.GetBlob(fresh.Hash); err != nil {
+			blob = fresh
+		}
+	}
+
+	// 去重命中时沿用已有 blob 的类型，链接扩展名与实际内容保持一致
+	useBlob := func(blob *storage.Blob) {
+		img.Filename = id + filepath.Ext(blob.Filename)
+		img.Size = blob.Size
+		img.MimeType = blob.MimeType
+	}
+	useBlob(blob)
+
+	result := &IngestResult{Image: img}
+
+	// 可选的近似重复检测
+	if (opts.NearDuplicate == "warn" || opts.NearDuplicate == "reject") && blob.PHash != "" {
+		result.Similar, _ = h.db.FindSimilar(blob.PHash, opts.Threshold, 10, "", opts.SimilarOwner)
+		if opts.NearDuplicate == "reject" && len(result.Similar) > 0 {
+			if fresh != nil {
+				os.Remove(dstPath)
+			}
+			return result, ErrNearDuplicate
+		}
+	}
+
+	// 文件已落盘后再提交数据库记录：崩溃时最多留下无记录的文件，
+	// 不会出现指向缺失文件的记录
+	err = h.db.SaveImage(img, blob)
+	if errors.Is(err, storage.ErrBlobGone) {
+		// 查找之后 blob 被并发删除，其文件可能已不存在：改用本次上传的内容
+		if fresh == nil {
+			fresh, err = storeBlob(cfg, tmpPath, dstPath, fileHash, outMime, opts)
+			if err != nil {
+				return nil, err
+			}
+		}
+		blob = fresh
+		useBlob(blob)
+		err = h.db.SaveImage(img, blob)
+	}
+	if err != nil {
+		if fresh != nil {
+			os.Remove(dstPath)
+		}
+		var quotaErr *storage.QuotaError
+		if errors.As(err, &quotaErr) {
+			return nil, err
+		}
+		return nil, errSaveMetadata
+	}
+
+	// 命中已有 blob（包括并发上传相同内容时由其他请求先写入）时本次文件多余
+	result.Duplicate = blob.Filename != filename
+	if fresh != nil && result.Duplicate {
+		os.Remove(dstPath)
+	}
+
+	return result, nil
+}
+
+// storeBlob 处理 tmpPath 中的上传内容并写入 dstPath，返回尚未登记到数据库的
+// 新 blob。不需要重新编码时 tmpPath 会被直接 rename 为 dstPath。
+func storeBlob(cfg *storage.Config, tmpPath, dstPath, fileHash, outMime string, opts IngestOptions) (*storage.Blob, error) {
+	var outputHash, phash string
+	var err error
+	if opts.KeepOriginal {
+		phash = dHashFile(tmpPath)
+		outputHash, err = fileHash, storage.CommitFile(tmpPath, dstPath)
+	} else {
+		outputHash, phash, err = compressImage(cfg, tmpPath, dstPath, opts.MimeType, outMime, fileHash)
+	}
+	if err != nil {
+		os.Remove(dstPath)
+		return nil, errProcessImage
+	}
+
+	// Get actual file size after compression
+	fileInfo, err := os.Stat(dstPath)
+	if err != nil {
+		os.Remove(dstPath)
+		return nil, errFileInfo
+	}
+
+	width, height := imageSize(dstPath)
+	return &storage.Blob{
+		Hash:       outputHash,
+		SourceHash: fileHash,
+		Filename:   filepath.Base(dstPath),
+		Size:       fileInfo.Size(),
+		MimeType:   outMime,
+		PHash:      phash,
+		Width:      width,
+		Height:     height,
+	}, nil
+}
+
+// imageSize 只读取图片头部获取尺寸，无法解码的格式（如 SVG）返回 0
+func imageSize(path string) (int, int) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, 0
+	}
+	defer f.Close()
+
+	cfg, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return 0, 0
+	}
+	return cfg.Width, cfg.Height
+}
+
+// RemoveImage 按 trash_retention_days 把图片移入回收站，或在回收站关闭时
+// 直接彻底删除。trashed 报告图片是否进入了回收站。
+func (h *Handler) RemoveImage(id string) (trashed bool, err error) {
+	cfg, err := h.db.GetConfig()
+	if err != nil {
+		return false, errLoadConfig
+	}
+	if cfg.TrashRetentionDays == 0 {
+		return false, h.DeleteImage(id)
+	}
+	return true, h.db.TrashImage(id)
+}
+
+// DeleteImage 彻底删除图片记录，最后一个引用被删除时同时删除磁盘文件
+func (h *Handler) DeleteImage(id string) error {
+	orphan, err := h.db.DeleteImage(id)
+	if err != nil {
+		return err
+	}
+
+	if orphan != nil {
+		os.Remove(filepath.Join(h.Config().UploadDir, orphan.Filename))
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+package handler
+
+import (
+	"log"
+	"time"
+)
+
+// janitorBatch 是每轮清理最多处理的图片数
+const janitorBatch = 500
+
+// SystemActor 是后台任务和配置热重载写入审计记录时的操作者
+const SystemActor = "system"
+
+// authFailureRetention 是认证失败记录的保留时间
+const authFailureRetention = 30 * 24 * time.Hour
+
+// RunJanitor 周期性地清理超过保留期限（retention_days）的图片、已过期
+// （expires_at）或访问次数用完（max_views）的图片、回收站中超过
+// trash_retention_days 的图片、过旧的认证失败记录和访问统计，直到进程退出
+func (h *Handler) RunJanitor(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		h.purgeExpired()
+		h.purgeSelfDestructed()
+		h.purgeTrash()
+		if _, err := h.db.PruneAuthFailures(time.Now().Add(-authFailureRetention)); err != nil {
+			log.Println("Janitor: failed to prune auth failures:", err)
+		}
+		if _, err := h.db.PruneImageStats(statsSince(statsRetention)); err != nil {
+			log.Println("Janitor: failed to prune view stats:", err)
+		}
+		<-ticker.C
+	}
+}
+
+// purgeExpired 把创建时间早于保留期限的图片按删除操作处理：回收站开启时移入
+// 回收站，否则彻底删除。每张图片都以 system 身份写入 image.delete 审计记录。
+// 这是破坏性的设置：调小 retention_days 会在下一轮清理时删除大量图片。
+func (h *Handler) purgeExpired() {
+	cfg, err := h.db.GetConfig()
+	if err != nil || cfg.RetentionDays == 0 {
+		return
+	}
+
+	cutoff := time.Now().AddDate(0, 0, -cfg.RetentionDays)
+	for {
+		ids, err := h.db.ImagesCreatedBefore(cutoff, janitorBatch)
+		if err != nil {
+			log.Println("Janitor: failed to list expired images:", err)
+			return
+		}
+
+		for _, id := range ids {
+			img, err := h.db.GetImage(id)
+			if err != nil {
+				log.Printf("Janitor: failed to load %s: %v", id, err)
+				return
+			}
+			if _, err := h.RemoveImage(id); err != nil {
+				log.Printf("Janitor: failed to delete %s: %v", id, err)
+				return
+			}
+			h.Audit(SystemActor, "", "image.delete", id, img, nil)
+		}
+		if len(ids) > 0 {
+			log.Printf("Janitor: removed %d images older than %d days", len(ids), cfg.RetentionDays)
+		}
+		if len(ids) < janitorBatch {
+			return
+		}
+	}
+}
+
+// purgeSelfDestructed 彻底删除 expires_at 已过或访问次数已用完的图片（不经过
+// 回收站），每张图片都以 system 身份写入 image.delete 审计记录
+func (h *Handler) purgeSelfDestructed() {
+	for {
+		ids, err := h.db.ExpiredImages(time.Now(), janitorBatch)
+		if err != nil {
+			log.Println("Janitor: failed to list expired uploads:", err)
+			return
+		}
+
+		for _, id := range ids {
+			img, err := h.db.GetImage(id)
+			if err != nil {
+				log.Printf("Janitor: failed to load %s: %v", id, err)
+				return
+			}
+			if err := h.DeleteImage(id); err != nil {
+				log.Printf("Janitor: failed to delete %s: %v", id, err)
+				return
+			}
+			h.Audit(SystemActor, "", "image.delete", id, img, nil)
+		}
+		if len(ids) > 0 {
+			log.Printf("Janitor: removed %d expired uploads", len(ids))
+		}
+		if len(ids) < janitorBatch {
+			return
+		}
+	}
+}
+
+// purgeTrash 彻底删除在回收站中超过 trash_retention_days 的图片，每张图片
+// 都以 system 身份写入 image.purge 审计记录
+func (h *Handler) purgeTrash() {
+	cfg, err := h.db.GetConfig()
+	if err != nil {
+		return
+	}
+
+	// trash_retention_days 为 0 时回收站关闭，之前留下的图片立即清理
+	cutoff := time.Now().AddDate(0, 0, -cfg.TrashRetentionDays)
+	for {
+		ids, err := h.db.TrashedBefore(cutoff, janitorBatch)
+		if err != nil {
+			log.Println("Janitor: failed to list trashed images:", err)
+			return
+		}
+
+		for _, id := range ids {
+			img, err := h.db.GetImage(id)
+			if err != nil {
+				log.Printf("Janitor: failed to load %s: %v", id, err)
+				return
+			}
+			if err := h.DeleteImage(id); err != nil {
+				log.Printf("Janitor: failed to purge %s: %v", id, err)
+				return
+			}
+			h.Audit(SystemActor, "", "image.purge", id, img, nil)
+		}
+		if len(ids) > 0 {
+			log.Printf("Janitor: purged %d images from trash", len(ids))
+		}
+		if len(ids) < janitorBatch {
+			return
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package handler
+
+import (
+	"fmt"
+	"image"
+	_ "image/gif"
+	"os"
+
+	"github.com/disintegration/imaging"
+)
+
+// 默认相似阈值：64 位 dHash 中不同位数不超过该值视为相似
+const defaultSimilarThreshold = 10
+
+// dHash computes a 64-bit difference hash: the image is shrunk to 9x8
+// grayscale and each bit records whether a pixel is brighter than its
+// right-hand neighbour. Re-encoding or mild resizing barely changes it.
+func dHash(img image.Image) string {
+	small := imaging.Grayscale(imaging.Resize(img, 9, 8, imaging.Box))
+
+	var hash uint64
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			left := small.Pix[small.PixOffset(x, y)]
+			right := small.Pix[small.PixOffset(x+1, y)]
+			hash <<= 1
+			if left > right {
+				hash |= 1
+			}
+		}
+	}
+	return fmt.Sprintf("%016x", hash)
+}
+
+// dHashFile decodes the image at path and returns its dHash, or "" if the
+// format cannot be decoded (e.g. SVG).
+func dHashFile(path string) string {
+	f, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return ""
+	}
+	return dHash(img)
+}
@@ -0,0 +1,154 @@
+package handler
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+
+	"img-bed/middleware"
+	"img-bed/storage"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// LookupAPIKey 返回 API 密钥所属的所有者和密钥 ID，供 middleware.Auth 使用
+func (h *Handler) LookupAPIKey(secret string) (string, string, bool) {
+	if !strings.HasPrefix(secret, storage.APIKeyPrefix) {
+		return "", "", false
+	}
+	key, err := h.db.GetAPIKey(secret)
+	if err != nil {
+		return "", "", false
+	}
+	return key.Owner, key.ID, true
+}
+
+// validOwner 检查所有者名称：不能为空、不能冒充管理员
+func validOwner(owner string) error {
+	if owner == "" || len(owner) > 64 {
+		return errors.New("owner must be 1-64 characters")
+	}
+	if owner == middleware.AdminOwner {
+		return errors.New("owner name is reserved")
+	}
+	return nil
+}
+
+// CreateAPIKey 为用户生成 API 密钥。明文密钥只在此响应中出现一次。
+func (h *Handler) CreateAPIKey(c *fiber.Ctx) error {
+	var req struct {
+		Owner      string `json:"owner"`
+		DefaultTTL string `json:"default_ttl"`
+	}
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "invalid request"})
+	}
+	req.Owner = strings.TrimSpace(req.Owner)
+	if err := validOwner(req.Owner); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+	if req.DefaultTTL != "" {
+		if _, err := parseTTL(req.DefaultTTL); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "default_ttl: " + err.Error()})
+		}
+	}
+
+	key, secret, err := h.db.CreateAPIKey(req.Owner, req.DefaultTTL)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "failed to create key"})
+	}
+	h.audit(c, "key.create", key.ID, nil, key)
+
+	return c.JSON(fiber.Map{
+		"id":          key.ID,
+		"owner":       key.Owner,
+		"prefix":      key.Prefix,
+		"default_ttl": key.DefaultTTL,
+		"created_at":  key.CreatedAt,
+		"key":         secret,
+	})
+}
+
+func (h *Handler) ListAPIKeys(c *fiber.Ctx) error {
+	keys, err := h.db.ListAPIKeys()
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "failed to list keys"})
+	}
+
+	if keys == nil {
+		keys = []storage.APIKey{}
+	}
+
+	return c.JSON(keys)
+}
+
+func (h *Handler) DeleteAPIKey(c *fiber.Ctx) error {
+	key, err := h.db.GetAPIKeyByID(c.Params("id"))
+	if err == nil {
+		err = h.db.DeleteAPIKey(key.ID)
+	}
+	if err == sql.ErrNoRows {
+		return c.Status(404).JSON(fiber.Map{"error": "key not found"})
+	}
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "failed to delete key"})
+	}
+	h.audit(c, "key.delete", key.ID, key, nil)
+
+	return c.JSON(fiber.Map{"success": true})
+}
+
+func (h *Handler) ListQuotas(c *fiber.Ctx) error {
+	quotas, err := h.db.ListQuotas()
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "failed to list quotas"})
+	}
+
+	if quotas == nil {
+		quotas = []storage.QuotaUsage{}
+	}
+
+	return c.JSON(quotas)
+}
+
+// SetQuota 设置用户配额，max_bytes / max_images 为 0 表示不限制
+func (h *Handler) SetQuota(c *fiber.Ctx) error {
+	var req storage.Quota
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "invalid request"})
+	}
+	req.Owner = c.Params("owner")
+	if err := validOwner(req.Owner); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+	if req.MaxBytes < 0 || req.MaxImages < 0 {
+		return c.Status(400).JSON(fiber.Map{"error": "max_bytes and max_images must not be negative"})
+	}
+
+	before, _ := h.db.GetQuota(req.Owner)
+	if err := h.db.SetQuota(&req); err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "failed to set quota"})
+	}
+	h.audit(c, "quota.set", req.Owner, before, req)
+
+	return c.JSON(req)
+}
+
+func (h *Handler) DeleteQuota(c *fiber.Ctx) error {
+	before, _ := h.db.GetQuota(c.Params("owner"))
+	if err := h.db.DeleteQuota(c.Params("owner")); err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "failed to delete quota"})
+	}
+	h.audit(c, "quota.delete", c.Params("owner"), before, nil)
+
+	return c.JSON(fiber.Map{"success": true})
+}
+
+// quotaExceeded 返回超出配额的 413 响应，附带配额和当前使用量
+func quotaExceeded(c *fiber.Ctx, err *storage.QuotaError) error {
+	return c.Status(413).JSON(fiber.Map{
+		"error": err.Error(),
+		"quota": err.Quota,
+		"usage": err.Usage,
+	})
+}
@@ -0,0 +1,176 @@
+package handler
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"img-bed/storage"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// banList 是 ip_bans 表在内存中的副本，每个请求都要检查，避免查询数据库
+type banList struct {
+	mu    sync.RWMutex
+	until map[string]time.Time
+}
+
+func (b *banList) load(db *storage.DB) {
+	bans, err := db.ListBans()
+	if err != nil {
+		log.Println("Failed to load IP bans:", err)
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.until = make(map[string]time.Time, len(bans))
+	for _, ban := range bans {
+		b.until[ban.IP] = ban.Until
+	}
+}
+
+func (b *banList) set(ip string, until time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.until == nil {
+		b.until = make(map[string]time.Time)
+	}
+	b.until[ip] = until
+}
+
+func (b *banList) remove(ip string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.until, ip)
+}
+
+// Banned 返回 ip 是否被封禁以及剩余时间，供 middleware.IPBan 使用
+func (h *Handler) Banned(ip string) (time.Duration, bool) {
+	h.bans.mu.RLock()
+	until, ok := h.bans.until[ip]
+	h.bans.mu.RUnlock()
+
+	if !ok {
+		return 0, false
+	}
+	if wait := time.Until(until); wait > 0 {
+		return wait, true
+	}
+	h.bans.remove(ip)
+	return 0, false
+}
+
+// 每个 IP 每秒最多写入 authFailureRate 条认证失败记录（允许 authFailureBurst
+// 条突发），超出的失败不再记录，避免未认证的客户端让服务无限制地写数据库
+const (
+	authFailureRate  = 1
+	authFailureBurst = 10
+)
+
+// Locked 报告 ip 是否因连续认证失败被锁定以及剩余时间
+func (h *Handler) Locked(ip string) (bool, time.Duration) {
+	return h.lockout.Locked(ip)
+}
+
+// TokenFailed 记录一次令牌校验失败并计入锁定次数。登录和受保护接口的
+// Bearer 令牌共用同一个锁定计数，不能绕过登录接口无限制地猜测令牌。
+func (h *Handler) TokenFailed(c *fiber.Ctx, reason string) {
+	h.AuthFailed(c, reason)
+	if h.lockout.Fail(c.IP()) {
+		log.Printf("Token checks locked out for %s after repeated failures", c.IP())
+	}
+}
+
+// AuthFailed 记录一次认证失败；启用 auth_ban 时，同一 IP 在时间窗口内
+// 失败次数达到阈值后临时封禁该 IP
+func (h *Handler) AuthFailed(c *fiber.Ctx, reason string) {
+	if ok, _ := h.failureLimit.Allow(c.IP()); !ok {
+		return
+	}
+
+	ua := c.Get(fiber.HeaderUserAgent)
+	if len(ua) > 256 {
+		ua = ua[:256]
+	}
+
+	failure := &storage.AuthFailure{
+		IP:        c.IP(),
+		UserAgent: ua,
+		Path:      c.Path(),
+		Reason:    reason,
+	}
+	if err := h.db.RecordAuthFailure(failure); err != nil {
+		log.Println("Failed to record auth failure:", err)
+		return
+	}
+
+	policy := h.Config().AuthBan
+	if policy.Threshold <= 0 {
+		return
+	}
+
+	n, err := h.db.CountAuthFailures(failure.IP, failure.CreatedAt.Add(-policy.Window))
+	if err != nil || n < int64(policy.Threshold) {
+		return
+	}
+
+	ban := &storage.IPBan{
+		IP:     failure.IP,
+		Reason: reason,
+		Until:  time.Now().Add(policy.Duration),
+	}
+	if err := h.db.BanIP(ban); err != nil {
+		log.Println("Failed to ban IP:", err)
+		return
+	}
+	h.bans.set(ban.IP, ban.Until)
+	log.Printf("Banned %s until %s after %d failed auth attempts", ban.IP, ban.Until.Format(time.RFC3339), n)
+}
+
+// ListAuthFailures 列出认证失败记录，可按 ip 过滤
+func (h *Handler) ListAuthFailures(c *fiber.Ctx) error {
+	limit := c.QueryInt("limit", 50)
+	offset := c.QueryInt("offset", 0)
+
+	if limit > 100 {
+		limit = 100
+	}
+
+	failures, err := h.db.ListAuthFailures(c.Query("ip"), limit, offset)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "failed to list auth failures"})
+	}
+
+	if failures == nil {
+		failures = []storage.AuthFailure{}
+	}
+
+	return c.JSON(failures)
+}
+
+func (h *Handler) ListBans(c *fiber.Ctx) error {
+	bans, err := h.db.ListBans()
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "failed to list bans"})
+	}
+
+	if bans == nil {
+		bans = []storage.IPBan{}
+	}
+
+	return c.JSON(bans)
+}
+
+// Unban 提前解除对某个 IP 的封禁
+func (h *Handler) Unban(c *fiber.Ctx) error {
+	ip := c.Params("ip")
+	if err := h.db.UnbanIP(ip); err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "failed to unban"})
+	}
+	h.bans.remove(ip)
+	h.audit(c, "ban.delete", ip, nil, nil)
+
+	return c.JSON(fiber.Map{"success": true})
+}
@@ -0,0 +1,166 @@
+package handler
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"net/url"
+	"strconv"
+	"time"
+
+	"img-bed/middleware"
+	"img-bed/storage"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	defaultSignTTL = time.Hour
+	maxSignTTL     = 30 * 24 * time.Hour
+)
+
+// signingKey 返回签名密钥，未配置时由管理员令牌派生
+func (h *Handler) signingKey() []byte {
+	cfg := h.Config()
+	if cfg.SigningKey != "" {
+		return []byte(cfg.SigningKey)
+	}
+	mac := hmac.New(sha256.New, []byte(cfg.AuthToken))
+	mac.Write([]byte("imgbed signed urls"))
+	return mac.Sum(nil)
+}
+
+// signature 计算 filename 在 expires（Unix 秒）之前有效的签名
+func (h *Handler) signature(filename string, expires int64) string {
+	mac := hmac.New(sha256.New, h.signingKey())
+	mac.Write([]byte(filename + "\n" + strconv.FormatInt(expires, 10)))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// signedURL 返回带有效期和签名的图片链接
+func (h *Handler) signedURL(c *fiber.Ctx, filename string, expires time.Time) string {
+	q := url.Values{}
+	q.Set("expires", strconv.FormatInt(expires.Unix(), 10))
+	q.Set("sig", h.signature(filename, expires.Unix()))
+	return h.imageURL(c, filename) + "?" + q.Encode()
+}
+
+// previewSignature 计算预览链接的签名。签名内容与普通签名链接不同，
+// 普通签名链接加上 preview 参数不能当作预览链接使用
+func (h *Handler) previewSignature(filename string, expires int64) string {
+	return h.signature(filename+"\npreview", expires)
+}
+
+// previewURL 返回管理面板使用的预览链接，访问时不计入访问次数和统计
+func (h *Handler) previewURL(c *fiber.Ctx, filename string, expires time.Time) string {
+	q := url.Values{}
+	q.Set("expires", strconv.FormatInt(expires.Unix(), 10))
+	q.Set("preview", "1")
+	q.Set("sig", h.previewSignature(filename, expires.Unix()))
+	return h.imageURL(c, filename) + "?" + q.Encode()
+}
+
+// verifySignature 校验请求中的 expires / sig 参数，返回链接剩余的有效时间。
+// preview 为 true 时按预览链接校验。
+func (h *Handler) verifySignature(c *fiber.Ctx, filename string, preview bool) (time.Duration, bool) {
+	expires, err := strconv.ParseInt(c.Query("expires"), 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	sig := h.signature(filename, expires)
+	if preview {
+		sig = h.previewSignature(filename, expires)
+	}
+	if !hmac.Equal([]byte(c.Query("sig")), []byte(sig)) {
+		return 0, false
+	}
+	remaining := time.Until(time.Unix(expires, 0))
+	return remaining, remaining > 0
+}
+
+// Sign 为图片签发有时效的访问链接（ttl 如 30m、24h，默认 1h，最长 30 天），
+// 私有图片只能通过这种链接访问
+func (h *Handler) Sign(c *fiber.Ctx) error {
+	img, err := h.db.GetImage(c.Params("id"))
+	if err != nil || img.DeletedAt != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "image not found"})
+	}
+	if expired(img) || exhausted(img) {
+		return c.Status(410).JSON(fiber.Map{"error": "image expired"})
+	}
+
+	if !middleware.IsAdmin(c) && img.Owner != middleware.Owner(c) {
+		return c.Status(403).JSON(fiber.Map{"error": "not the owner of this image"})
+	}
+
+	var req struct {
+		TTL string `json:"ttl"`
+	}
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&req); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "invalid request"})
+		}
+	}
+	if req.TTL == "" {
+		req.TTL = c.Query("ttl")
+	}
+
+	ttl := defaultSignTTL
+	if req.TTL != "" {
+		ttl, err = time.ParseDuration(req.TTL)
+		if err != nil || ttl <= 0 || ttl > maxSignTTL {
+			return c.Status(400).JSON(fiber.Map{"error": "ttl must be a duration between 1s and 720h"})
+		}
+	}
+
+	// 链接不会比图片本身存活得更久
+	expires := time.Now().Add(capExpiry(img, ttl)).Truncate(time.Second)
+	return c.JSON(fiber.Map{
+		"url":        h.signedURL(c, img.Filename, expires),
+		"expires_at": expires,
+		"visibility": img.Visibility,
+	})
+}
+
+// SetVisibility 修改单张图片的可见性，请求体为 {"visibility": "private"}。
+// API 密钥用户只能修改自己的图片。
+func (h *Handler) SetVisibility(c *fiber.Ctx) error {
+	var req struct {
+		Visibility string `json:"visibility"`
+	}
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "invalid request"})
+	}
+	if !validVisibility(req.Visibility) {
+		return c.Status(400).JSON(fiber.Map{"error": "visibility must be public or private"})
+	}
+
+	img, err := h.db.GetImage(c.Params("id"))
+	if err != nil || img.DeletedAt != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "image not found"})
+	}
+
+	if !middleware.IsAdmin(c) && img.Owner != middleware.Owner(c) {
+		return c.Status(403).JSON(fiber.Map{"error": "not the owner of this image"})
+	}
+
+	if err := h.db.SetVisibility(img.ID, req.Visibility); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return c.Status(404).JSON(fiber.Map{"error": "image not found"})
+		}
+		return c.Status(500).JSON(fiber.Map{"error": "failed to update visibility"})
+	}
+
+	updated := *img
+	updated.Visibility = req.Visibility
+	h.audit(c, "image.visibility", img.ID, img, &updated)
+
+	return c.JSON(fiber.Map{"success": true, "visibility": req.Visibility})
+}
+
+// validVisibility 报告 v 是否为合法的可见性取值
+func validVisibility(v string) bool {
+	return v == storage.VisibilityPublic || v == storage.VisibilityPrivate
+}
@@ -0,0 +1,83 @@
+package handler
+
+import (
+	"database/sql"
+	"errors"
+
+	"img-bed/middleware"
+	"img-bed/storage"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Trash 列出回收站中的图片。API 密钥用户只能看到自己的图片。
+func (h *Handler) Trash(c *fiber.Ctx) error {
+	limit := c.QueryInt("limit", 50)
+	offset := c.QueryInt("offset", 0)
+
+	if limit > 100 {
+		limit = 100
+	}
+
+	owner := ""
+	if !middleware.IsAdmin(c) {
+		owner = middleware.Owner(c)
+	}
+
+	images, err := h.db.ListTrash(owner, limit, offset)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "failed to list trash"})
+	}
+
+	if images == nil {
+		images = []storage.Image{}
+	}
+
+	return c.JSON(images)
+}
+
+// trashedImage 查找回收站中的图片并检查所有权，失败时已写入响应
+func (h *Handler) trashedImage(c *fiber.Ctx) (*storage.Image, error) {
+	img, err := h.db.GetImage(c.Params("id"))
+	if err != nil || img.DeletedAt == nil {
+		return nil, c.Status(404).JSON(fiber.Map{"error": "image not in trash"})
+	}
+
+	if !middleware.IsAdmin(c) && img.Owner != middleware.Owner(c) {
+		return nil, c.Status(403).JSON(fiber.Map{"error": "not the owner of this image"})
+	}
+	return img, nil
+}
+
+// Restore 把回收站中的图片恢复，原有链接重新可用
+func (h *Handler) Restore(c *fiber.Ctx) error {
+	img, err := h.trashedImage(c)
+	if img == nil {
+		return err
+	}
+
+	if err := h.db.RestoreImage(img.ID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return c.Status(404).JSON(fiber.Map{"error": "image not in trash"})
+		}
+		return c.Status(500).JSON(fiber.Map{"error": "failed to restore"})
+	}
+	h.audit(c, "image.restore", img.ID, img, nil)
+
+	return c.JSON(fiber.Map{"success": true})
+}
+
+// Purge 彻底删除回收站中的图片，不等待 trash_retention_days
+func (h *Handler) Purge(c *fiber.Ctx) error {
+	img, err := h.trashedImage(c)
+	if img == nil {
+		return err
+	}
+
+	if err := h.DeleteImage(img.ID); err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "failed to delete"})
+	}
+	h.audit(c, "image.purge", img.ID, img, nil)
+
+	return c.JSON(fiber.Map{"success": true})
+}
@@ -0,0 +1,194 @@
+package handler
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"img-bed/middleware"
+	"img-bed/storage"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// statsRetention 是每日访问统计的保留天数
+const statsRetention = 365
+
+// viewStats 在内存中累计图片的访问次数和流量，由 RunStatsFlusher 定期
+// 批量写入数据库，避免每次访问都写一次 SQLite
+type viewStats struct {
+	mu      sync.Mutex
+	pending map[storage.StatsKey]storage.StatsDelta
+}
+
+// record 记录一次访问。counted 为 true 表示访问次数已由 RecordView 写入
+// images.views，这里只累计每日统计。
+func (v *viewStats) record(id string, bytes int64, counted bool) {
+	key := storage.StatsKey{ImageID: id, Day: storage.StatsDay(time.Now())}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if v.pending == nil {
+		v.pending = make(map[storage.StatsKey]storage.StatsDelta)
+	}
+	d := v.pending[key]
+	d.Hits++
+	d.Bytes += bytes
+	if !counted {
+		d.Views++
+	}
+	v.pending[key] = d
+}
+
+// take 取出并清空已累计的增量
+func (v *viewStats) take() map[storage.StatsKey]storage.StatsDelta {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	pending := v.pending
+	v.pending = nil
+	return pending
+}
+
+// restore 在写入失败时把增量放回，等待下次写入
+func (v *viewStats) restore(deltas map[storage.StatsKey]storage.StatsDelta) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if v.pending == nil {
+		v.pending = make(map[storage.StatsKey]storage.StatsDelta)
+	}
+	for key, d := range deltas {
+		p := v.pending[key]
+		p.Hits += d.Hits
+		p.Bytes += d.Bytes
+		p.Views += d.Views
+		v.pending[key] = p
+	}
+}
+
+// FlushStats 把内存中累计的访问统计写入数据库
+func (h *Handler) FlushStats() {
+	deltas := h.views.take()
+	if len(deltas) == 0 {
+		return
+	}
+	if err := h.db.AddImageStats(deltas); err != nil {
+		log.Println("Failed to flush view stats:", err)
+		h.views.restore(deltas)
+	}
+}
+
+// RunStatsFlusher 每隔 interval 把访问统计写入数据库，直到进程退出
+func (h *Handler) RunStatsFlusher(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		h.FlushStats()
+	}
+}
+
+// recordServed 在 GetImage 发送文件后记录本次访问。HEAD 请求和失败的
+// 请求不计数，流量按实际发送的响应体长度计算（304 为 0）。
+func (h *Handler) recordServed(c *fiber.Ctx, img *storage.Image, counted bool) {
+	if c.Method() != fiber.MethodGet || c.Response().StatusCode() >= 400 {
+		return
+	}
+	bytes := int64(c.Response().Header.ContentLength())
+	if bytes < 0 {
+		bytes = 0
+	}
+	h.views.record(img.ID, bytes, counted)
+}
+
+// statsSince 返回最近 days 天（含今天）的第一天
+func statsSince(days int) string {
+	return storage.StatsDay(time.Now().AddDate(0, 0, -(days - 1)))
+}
+
+// ImageStats 返回图片最近 days 天（默认 30，最多 365）每天的访问次数和流量
+func (h *Handler) ImageStats(c *fiber.Ctx) error {
+	img, err := h.db.GetImage(c.Params("id"))
+	if err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "image not found"})
+	}
+
+	if !middleware.IsAdmin(c) && img.Owner != middleware.Owner(c) {
+		return c.Status(403).JSON(fiber.Map{"error": "not the owner of this image"})
+	}
+
+	days := c.QueryInt("days", 30)
+	if days < 1 || days > statsRetention {
+		return c.Status(400).JSON(fiber.Map{"error": "days must be between 1 and 365"})
+	}
+
+	// 先写入内存中的增量，返回的统计包含最近的访问
+	h.FlushStats()
+	if img, err = h.db.GetImage(img.ID); err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "image not found"})
+	}
+
+	daily, err := h.db.ImageStats(img.ID, statsSince(days))
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "failed to load stats"})
+	}
+	if daily == nil {
+		daily = []storage.DailyStats{}
+	}
+
+	var hits, bytes int64
+	for _, d := range daily {
+		hits += d.Hits
+		bytes += d.Bytes
+	}
+
+	return c.JSON(fiber.Map{
+		"id":        img.ID,
+		"views":     img.Views,
+		"max_views": img.MaxViews,
+		"days":      days,
+		"hits":      hits,
+		"bytes":     bytes,
+		"daily":     daily,
+	})
+}
+
+// TopImages 返回最近 days 天（默认 7）访问最多的 limit 张图片（默认 10，最多 100），
+// sort=bytes 时按流量排序。API 密钥用户只统计自己的图片。
+func (h *Handler) TopImages(c *fiber.Ctx) error {
+	days := c.QueryInt("days", 7)
+	if days < 1 || days > statsRetention {
+		return c.Status(400).JSON(fiber.Map{"error": "days must be between 1 and 365"})
+	}
+
+	limit := c.QueryInt("limit", 10)
+	if limit < 1 {
+		limit = 10
+	}
+	if limit > 100 {
+		limit = 100
+	}
+
+	sort := c.Query("sort", "hits")
+	if sort != "hits" && sort != "bytes" {
+		return c.Status(400).JSON(fiber.Map{"error": "sort must be hits or bytes"})
+	}
+
+	owner := ""
+	if !middleware.IsAdmin(c) {
+		owner = middleware.Owner(c)
+	}
+
+	h.FlushStats()
+	top, err := h.db.TopImages(owner, statsSince(days), sort, limit)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "failed to load stats"})
+	}
+	if top == nil {
+		top = []storage.TopImage{}
+	}
+
+	return c.JSON(top)
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"img-bed/config"
+	"img-bed/handler"
+	"img-bed/middleware"
+	"img-bed/storage"
+)
+
+// importStats 统计导入进度，由多个 worker 并发更新
+type importStats struct {
+	total    int64
+	imported int64
+	skipped  int64
+	failed   int64
+}
+
+func (s *importStats) done() int64 {
+	return atomic.LoadInt64(&s.imported) + atomic.LoadInt64(&s.skipped) + atomic.LoadInt64(&s.failed)
+}
+
+func (s *importStats) String() string {
+	return fmt.Sprintf("%d/%d processed: %d imported, %d skipped, %d failed",
+		s.done(), s.total, atomic.LoadInt64(&s.imported), atomic.LoadInt64(&s.skipped), atomic.LoadInt64(&s.failed))
+}
+
+// runImport 实现 `imgbed import <dir>`：并行导入目录树中的图片。
+// 已导入的文件记录在状态文件中，中断后重新运行会从断点继续；
+// 内容与已有图片相同的文件按 hash 跳过。
+func runImport(cfg *config.Config, args []string) int {
+	fset := flag.NewFlagSet("import", flag.ExitOnError)
+	workers := fset.Int("workers", runtime.NumCPU(), "number of parallel workers")
+	compress := fset.Bool("compress", false, "apply the runtime compression settings instead of storing originals")
+	statePath := fset.String("state", "imgbed-import.state", "file recording imported paths, used to resume")
+	owner := fset.String("owner", middleware.AdminOwner, "owner recorded for imported images")
+	fset.Parse(args)
+
+	if fset.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: imgbed import [flags] <dir>")
+		return 2
+	}
+	root := fset.Arg(0)
+
+	if err := os.MkdirAll(cfg.UploadDir, 0755); err != nil {
+		log.Fatal("Failed to create upload dir:", err)
+	}
+
+	db, err := openDB(cfg)
+	if err != nil {
+		log.Fatal("Failed to open database:", err)
+	}
+	defer db.Close()
+	h := handler.New(cfg, db)
+
+	done, err := loadImportState(*statePath)
+	if err != nil {
+		log.Fatal("Failed to read state file:", err)
+	}
+
+	stateFile, err := os.OpenFile(*statePath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		log.Fatal("Failed to open state file:", err)
+	}
+	defer stateFile.Close()
+
+	var paths []string
+	err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Type().IsRegular() {
+			paths = append(paths, path)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Fatal("Failed to walk directory:", err)
+	}
+
+	stats := &importStats{total: int64(len(paths))}
+	var stateMu sync.Mutex
+	// hashLocks 按内容 hash 串行化导入，内容相同的文件只会有一个被导入
+	var hashLocks sync.Map
+
+	// 定期输出进度
+	stop := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(2 * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				log.Println(stats)
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	jobs := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < max(*workers, 1); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for path := range jobs {
+				imported, err := importFile(h, db, &hashLocks, path, *owner, !*compress)
+				switch {
+				case err != nil:
+					atomic.AddInt64(&stats.failed, 1)
+					log.Printf("%s: %v", path, err)
+					continue
+				case imported:
+					atomic.AddInt64(&stats.imported, 1)
+				default:
+					atomic.AddInt64(&stats.skipped, 1)
+				}
+
+				stateMu.Lock()
+				fmt.Fprintln(stateFile, path)
+				stateMu.Unlock()
+			}
+		}()
+	}
+
+	for _, path := range paths {
+		if done[path] {
+			atomic.AddInt64(&stats.skipped, 1)
+			continue
+		}
+		jobs <- path
+	}
+	close(jobs)
+	wg.Wait()
+	close(stop)
+
+	log.Println(stats)
+	if stats.failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// importFile 导入单个文件，返回是否新增了图片。不支持的类型和
+// 内容已存在的文件会被跳过。
+func importFile(h *handler.Handler, db *storage.DB, hashLocks *sync.Map, path, owner string, keepOriginal bool) (bool, error) {
+	f, mimeType, err := sniffFile(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, f); err != nil {
+		return false, err
+	}
+	sum := hex.EncodeToString(hasher.Sum(nil))
+
+	// 持有该 hash 的锁直到导入结束：其他内容相同的文件等待后按数据库中的
+	// 记录跳过；若本次导入失败，下一个相同内容的文件会重新尝试
+	mu, _ := hashLocks.LoadOrStore(sum, &sync.Mutex{})
+	mu.(*sync.Mutex).Lock()
+	defer mu.(*sync.Mutex).Unlock()
+
+	if _, err := db.GetImageByHash(sum); err == nil {
+		return false, nil
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return false, err
+	}
+
+	_, err = h.Ingest(f, handler.IngestOptions{
+		OriginalName: filepath.Base(path),
+		MimeType:     mimeType,
+		Owner:        owner,
+		CreatedAt:    info.ModTime(),
+		KeepOriginal: keepOriginal,
+		Hash:         sum,
+	})
+	if err == handler.ErrUnsupportedType {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func loadImportState(path string) (map[string]bool, error) {
+	done := make(map[string]bool)
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return done, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			done[line] = true
+		}
+	}
+	return done, scanner.Err()
+}
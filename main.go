@@ -2,12 +2,15 @@ package main
 
 import (
 	"embed"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"img-bed/config"
 	"img-bed/handler"
@@ -24,21 +27,70 @@ import (
 var webFS embed.FS
 
 func main() {
-	cfg := config.Load()
+	cfg, rest, err := config.Load(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		fmt.Print(usage)
+		os.Exit(0)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Invalid configuration:", err)
+		os.Exit(2)
+	}
+
+	configArgs = os.Args[1 : len(os.Args)-len(rest)]
+
+	cmd, args := "serve", rest
+	if len(rest) > 0 {
+		cmd, args = rest[0], rest[1:]
+	}
+
+	os.Exit(runCommand(cfg, cmd, args))
+}
+
+// runServe 启动 HTTP 服务，直到收到 SIGINT/SIGTERM。
+// args 中的配置参数（如 `imgbed serve -port 9000`）覆盖已加载的配置。
+func runServe(cfg *config.Config, args []string) int {
+	serveArgs = args
+	if _, err := cfg.ParseFlags(args); err != nil {
+		return 2
+	}
+	if err := cfg.Validate(); err != nil {
+		fmt.Fprintln(os.Stderr, "Invalid configuration:", err)
+		return 2
+	}
+
+	if cfg.File != "" {
+		log.Println("Loaded config file", cfg.File)
+	}
+	if cfg.AuthToken == "changeme" {
+		log.Println("Warning: AUTH_TOKEN is the default value, set auth_token before exposing this server")
+	}
 
 	if err := os.MkdirAll(cfg.UploadDir, 0755); err != nil {
 		log.Fatal("Failed to create upload dir:", err)
 	}
 
-	db, err := storage.NewDB(cfg.DBPath)
+	// 清理上次异常退出时残留的临时文件
+	if n, err := storage.CleanTempFiles(cfg.UploadDir); err != nil {
+		log.Println("Failed to clean temp files:", err)
+	} else if n > 0 {
+		log.Printf("Removed %d leftover temp files", n)
+	}
+
+	db, err := openDB(cfg)
 	if err != nil {
 		log.Fatal("Failed to open database:", err)
 	}
 	defer db.Close()
 
+	// 请求体以流的形式交给处理函数，实际大小限制由 BodyLimit 中间件按运行时的
+	// max_size 执行；这里的 BodyLimit 只是上限
 	app := fiber.New(fiber.Config{
-		BodyLimit:             int(cfg.MaxSize),
-		DisableStartupMessage: true,
+		BodyLimit:                    storage.MaxUploadSize + 1024*1024,
+		StreamRequestBody:            true,
+		DisablePreParseMultipartForm: true,
+		DisableStartupMessage:        true,
+		ProxyHeader:                  cfg.ProxyHeader,
 	})
 
 	app.Use(recover.New())
@@ -47,26 +99,71 @@ func main() {
 	}))
 
 	h := handler.New(cfg, db)
+	app.Use(middleware.IPBan(h.Banned))
+	app.Use(middleware.BodyLimit(h.BodyLimit))
+
+	// 限流策略在每个请求时读取，热重载后立即生效
+	loginLimit := middleware.NewLimiter(func() (float64, int) {
+		rl := h.Config().RateLimit.Login
+		return rl.Rate, rl.Burst
+	})
+	uploadLimit := middleware.NewLimiter(func() (float64, int) {
+		rl := h.Config().RateLimit.Upload
+		return rl.Rate, rl.Burst
+	})
+	imageLimit := middleware.NewLimiter(func() (float64, int) {
+		rl := h.Config().RateLimit.Image
+		return rl.Rate, rl.Burst
+	})
 
 	// API routes
 	api := app.Group("/api")
 
 	// Public login endpoint
-	api.Post("/login", h.Login)
+	api.Post("/login", middleware.RateLimit(loginLimit), h.Login)
 
 	// Public config endpoint
 	api.Get("/config", h.GetConfig)
 
 	// Protected routes - require authentication
-	protected := api.Group("", middleware.Auth(cfg.AuthToken))
+	protected := api.Group("", middleware.Auth(func() string { return h.Config().AuthToken }, h.LookupAPIKey, h.Locked, h.TokenFailed))
 	protected.Get("/stats", h.Stats)
 	protected.Get("/images", h.List)
-	protected.Post("/upload", h.Upload)
+	protected.Get("/images/:id/similar", h.Similar)
+	protected.Get("/images/:id/stats", h.ImageStats)
+	protected.Get("/stats/top", h.TopImages)
+	protected.Post("/images/bulk", h.Bulk)
+	protected.Post("/images/:id/sign", h.Sign)
+	protected.Put("/images/:id/visibility", h.SetVisibility)
+	protected.Post("/images/:id/restore", h.Restore)
+	protected.Get("/trash", h.Trash)
+	protected.Delete("/trash/:id", h.Purge)
+	protected.Post("/upload", middleware.RateLimit(uploadLimit), h.Upload)
 	protected.Delete("/images/:id", h.Delete)
-	protected.Put("/config", h.UpdateConfig)
+
+	// Admin routes - require the admin token
+	admin := middleware.AdminOnly()
+	protected.Put("/config", admin, h.UpdateConfig)
+	protected.Get("/export", admin, h.Export)
+	protected.Get("/admin/fsck", admin, h.Fsck)
+	protected.Post("/admin/fsck", admin, h.Fsck)
+	protected.Get("/admin/backup", admin, h.Backup)
+	protected.Get("/admin/keys", admin, h.ListAPIKeys)
+	protected.Post("/admin/keys", admin, h.CreateAPIKey)
+	protected.Delete("/admin/keys/:id", admin, h.DeleteAPIKey)
+	protected.Get("/admin/quotas", admin, h.ListQuotas)
+	protected.Put("/admin/quotas/:owner", admin, h.SetQuota)
+	protected.Delete("/admin/quotas/:owner", admin, h.DeleteQuota)
+	protected.Get("/admin/hotlink", admin, h.ListHotlinkRules)
+	protected.Put("/admin/hotlink/:owner", admin, h.SetHotlinkRule)
+	protected.Delete("/admin/hotlink/:owner", admin, h.DeleteHotlinkRule)
+	protected.Get("/admin/auth-failures", admin, h.ListAuthFailures)
+	protected.Get("/admin/bans", admin, h.ListBans)
+	protected.Delete("/admin/bans/:ip", admin, h.Unban)
+	protected.Get("/audit", admin, h.ListAudit)
 
 	// Serve uploaded images
-	app.Get("/i/:filename", h.GetImage)
+	app.Get("/i/:filename", middleware.RateLimit(imageLimit), h.GetImage)
 
 	// Serve static files
 	app.Use("/static", filesystem.New(filesystem.Config{
@@ -81,6 +178,15 @@ func main() {
 		return c.Send(data)
 	})
 
+	// 定期清理超过保留期限、已过期和回收站中的图片
+	go h.RunJanitor(5 * time.Minute)
+
+	// 定期把内存中累计的访问统计写入数据库
+	go h.RunStatsFlusher(30 * time.Second)
+
+	// 收到 SIGHUP 或配置文件变化时热重载配置
+	go watchConfig(h, db, 2*time.Second)
+
 	// Graceful shutdown
 	go func() {
 		sigChan := make(chan os.Signal, 1)
@@ -96,6 +202,9 @@ func main() {
 	if err := app.Listen(":" + cfg.Port); err != nil {
 		log.Fatal(err)
 	}
+	// 关闭前写入尚未保存的访问统计
+	h.FlushStats()
+	return 0
 }
 
 func printBanner(port string) {
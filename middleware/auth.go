@@ -1,27 +1,97 @@
 package middleware
 
 import (
+	"crypto/sha256"
+	"crypto/subtle"
 	"strings"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
 )
 
-func Auth(token string) fiber.Handler {
+// AdminOwner 是使用全局 AUTH_TOKEN 认证时记录的所有者
+const AdminOwner = "admin"
+
+// Auth 校验 Bearer 令牌。token 在每个请求时调用，以便热重载后立即生效。
+// 令牌与 token() 相同时以管理员身份认证；否则交给 lookup 查找 API 密钥，
+// 返回密钥所属的所有者和密钥 ID。格式错误或无效的令牌会调用 onFail 记录；
+// locked 报告的被锁定 IP 在锁定期间直接返回 429，不再校验令牌。
+func Auth(token func() string, lookup func(key string) (owner, keyID string, ok bool), locked func(ip string) (bool, time.Duration), onFail func(c *fiber.Ctx, reason string)) fiber.Handler {
 	return func(c *fiber.Ctx) error {
 		auth := c.Get("Authorization")
 		if auth == "" {
 			return c.Status(401).JSON(fiber.Map{"error": "missing authorization header"})
 		}
 
+		if ok, wait := locked(c.IP()); ok {
+			return TooManyRequests(c, wait)
+		}
+
 		parts := strings.SplitN(auth, " ", 2)
 		if len(parts) != 2 || strings.ToLower(parts[0]) != "bearer" {
+			onFail(c, "invalid authorization format")
 			return c.Status(401).JSON(fiber.Map{"error": "invalid authorization format"})
 		}
 
-		if parts[1] != token {
+		if TokenEqual(parts[1], token()) {
+			c.Locals("owner", AdminOwner)
+			return c.Next()
+		}
+
+		owner, keyID, ok := lookup(parts[1])
+		if !ok {
+			onFail(c, "invalid token")
 			return c.Status(403).JSON(fiber.Map{"error": "invalid token"})
 		}
 
+		c.Locals("owner", owner)
+		c.Locals("key_id", keyID)
+		return c.Next()
+	}
+}
+
+// TokenEqual 以常量时间比较两个令牌。先取 SHA256 使比较时间与令牌长度无关。
+func TokenEqual(a, b string) bool {
+	ha := sha256.Sum256([]byte(a))
+	hb := sha256.Sum256([]byte(b))
+	return subtle.ConstantTimeCompare(ha[:], hb[:]) == 1
+}
+
+// IPBan 拒绝被临时封禁的 IP，banned 返回剩余封禁时间
+func IPBan(banned func(ip string) (time.Duration, bool)) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if wait, ok := banned(c.IP()); ok {
+			c.Context().SetConnectionClose()
+			c.Set(fiber.HeaderRetryAfter, retryAfter(wait))
+			return c.Status(403).JSON(fiber.Map{"error": "ip temporarily banned"})
+		}
 		return c.Next()
 	}
 }
+
+// AdminOnly 只允许使用管理员令牌的请求通过，必须在 Auth 之后使用
+func AdminOnly() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if !IsAdmin(c) {
+			return c.Status(403).JSON(fiber.Map{"error": "admin token required"})
+		}
+		return c.Next()
+	}
+}
+
+// IsAdmin 报告当前请求是否以管理员身份认证
+func IsAdmin(c *fiber.Ctx) bool {
+	return Owner(c) == AdminOwner
+}
+
+// Owner 返回当前请求认证后的所有者，未认证时返回空字符串
+func Owner(c *fiber.Ctx) string {
+	owner, _ := c.Locals("owner").(string)
+	return owner
+}
+
+// KeyID 返回当前请求使用的 API 密钥 ID，使用管理员令牌或未认证时返回空字符串
+func KeyID(c *fiber.Ctx) string {
+	id, _ := c.Locals("key_id").(string)
+	return id
+}
@@ -0,0 +1,63 @@
+package middleware
+
+import (
+	"io"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// BodyLimit 限制请求体大小，limit 在每个请求时调用，以便运行时修改立即生效。
+// 需要开启 fiber.Config.StreamRequestBody：声明的 Content-Length 超过限制时
+// 在读取请求体之前直接返回 413；分块传输（长度未知）的请求体最多读取
+// limit 字节，超出同样返回 413。
+func BodyLimit(limit func() int64) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		max := limit()
+
+		length := int64(c.Request().Header.ContentLength())
+		if length > max {
+			return TooLarge(c)
+		}
+
+		// 分块传输：先读入内存（不超过 max），之后的处理与普通请求相同
+		if length == -1 {
+			if stream := c.Context().RequestBodyStream(); stream != nil {
+				body, err := io.ReadAll(io.LimitReader(stream, max+1))
+				if err != nil {
+					c.Context().SetConnectionClose()
+					return c.Status(400).JSON(fiber.Map{"error": "failed to read request body"})
+				}
+				if int64(len(body)) > max {
+					return TooLarge(c)
+				}
+				c.Request().SetBody(body)
+			}
+		}
+
+		err := c.Next()
+		drainBody(c)
+		return err
+	}
+}
+
+// drainLimit 是处理完成后为复用连接最多读取的剩余请求体字节数
+const drainLimit = 64 * 1024
+
+// drainBody 处理函数可能没有读完请求体（如认证失败、限流、上传出错）。
+// 剩余数据较少时读完以便复用连接，否则关闭连接。
+func drainBody(c *fiber.Ctx) {
+	if c.Context().Response.ConnectionClose() {
+		return
+	}
+	if stream := c.Context().RequestBodyStream(); stream != nil {
+		if n, _ := io.CopyN(io.Discard, stream, drainLimit); n == drainLimit {
+			c.Context().SetConnectionClose()
+		}
+	}
+}
+
+// TooLarge 返回 413 并关闭连接：未读完的请求体无法在同一连接上继续处理
+func TooLarge(c *fiber.Ctx) error {
+	c.Context().SetConnectionClose()
+	return c.Status(fiber.StatusRequestEntityTooLarge).JSON(fiber.Map{"error": "request body too large"})
+}
@@ -0,0 +1,198 @@
+package middleware
+
+import (
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// bucket 是单个键的令牌桶
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Limiter 是按键（IP 或 API 密钥所有者）分组的令牌桶限流器。
+// policy 在每次请求时调用，返回每秒补充的令牌数和桶容量，以便热重载后
+// 立即生效；rate 为 0 表示不限流。
+type Limiter struct {
+	policy func() (rate float64, burst int)
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	sweep   time.Time
+}
+
+func NewLimiter(policy func() (rate float64, burst int)) *Limiter {
+	return &Limiter{
+		policy:  policy,
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// Allow 为 key 消耗一个令牌。令牌不足时返回 false 以及需要等待的时间。
+func (l *Limiter) Allow(key string) (bool, time.Duration) {
+	rate, burst := l.policy()
+	if rate <= 0 {
+		return true, 0
+	}
+	if burst < 1 {
+		burst = 1
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.sweepIdle(now, rate, burst)
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(burst), last: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens = math.Min(float64(burst), b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+
+	if b.tokens < 1 {
+		wait := time.Duration((1 - b.tokens) / rate * float64(time.Second))
+		return false, wait
+	}
+	b.tokens--
+	return true, 0
+}
+
+// sweepIdle 每分钟清理一次已经回满的桶，避免大量不同 IP 使内存无限增长
+func (l *Limiter) sweepIdle(now time.Time, rate float64, burst int) {
+	if now.Sub(l.sweep) < time.Minute {
+		return
+	}
+	l.sweep = now
+
+	full := time.Duration(float64(burst) / rate * float64(time.Second))
+	for key, b := range l.buckets {
+		if now.Sub(b.last) > full {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// RateLimit 返回使用 l 限流的中间件。已认证的请求按所有者限流，
+// 其余按客户端 IP 限流；超出限制时返回 429 和 Retry-After。
+func RateLimit(l *Limiter) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if ok, wait := l.Allow(RateLimitKey(c)); !ok {
+			return TooManyRequests(c, wait)
+		}
+		return c.Next()
+	}
+}
+
+// RateLimitKey 返回请求的限流键
+func RateLimitKey(c *fiber.Ctx) string {
+	if owner := Owner(c); owner != "" {
+		return "owner:" + owner
+	}
+	return "ip:" + c.IP()
+}
+
+// TooManyRequests 返回 429 和 Retry-After
+func TooManyRequests(c *fiber.Ctx, wait time.Duration) error {
+	c.Set(fiber.HeaderRetryAfter, retryAfter(wait))
+	return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{"error": "too many requests"})
+}
+
+// retryAfter 把等待时间转换为 Retry-After 的秒数，向上取整
+func retryAfter(wait time.Duration) string {
+	seconds := int(math.Ceil(wait.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	return strconv.Itoa(seconds)
+}
+
+// lockoutEntry 记录某个键连续失败的次数
+type lockoutEntry struct {
+	failures int
+	until    time.Time
+	last     time.Time
+}
+
+// Lockout 在连续失败达到阈值后锁定对应的键（例如登录 IP）一段时间。
+// policy 返回阈值和锁定时长，阈值为 0 表示不锁定。
+type Lockout struct {
+	policy func() (after int, duration time.Duration)
+
+	mu      sync.Mutex
+	entries map[string]*lockoutEntry
+	sweep   time.Time
+}
+
+func NewLockout(policy func() (after int, duration time.Duration)) *Lockout {
+	return &Lockout{
+		policy:  policy,
+		entries: make(map[string]*lockoutEntry),
+	}
+}
+
+// Locked 返回 key 是否处于锁定状态以及剩余时间
+func (l *Lockout) Locked(key string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	e, ok := l.entries[key]
+	if !ok {
+		return false, 0
+	}
+	if wait := time.Until(e.until); wait > 0 {
+		return true, wait
+	}
+	return false, 0
+}
+
+// Fail 记录一次失败，达到阈值时开始锁定并返回 true
+func (l *Lockout) Fail(key string) bool {
+	after, duration := l.policy()
+	if after <= 0 {
+		return false
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(l.sweep) > time.Minute {
+		l.sweep = now
+		for k, e := range l.entries {
+			// 锁定结束且长时间没有新失败的记录不再需要
+			if now.Sub(e.last) > duration && now.After(e.until) {
+				delete(l.entries, k)
+			}
+		}
+	}
+
+	e, ok := l.entries[key]
+	if !ok {
+		e = &lockoutEntry{}
+		l.entries[key] = e
+	}
+	e.failures++
+	e.last = now
+	if e.failures >= after {
+		e.failures = 0
+		e.until = now.Add(duration)
+		return true
+	}
+	return false
+}
+
+// Reset 在成功后清除 key 的失败记录
+func (l *Lockout) Reset(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.entries, key)
+}
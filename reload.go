@@ -0,0 +1,105 @@
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"img-bed/config"
+	"img-bed/handler"
+	"img-bed/storage"
+)
+
+// configArgs 是子命令之前的配置参数，serveArgs 是 serve 子命令的参数，
+// 重新加载配置时按同样的顺序再次应用
+var configArgs, serveArgs []string
+
+// watchConfig 在收到 SIGHUP 或配置文件修改时间变化时重新加载配置。
+// SIGHUP 同时丢弃缓存的运行时配置，以便读取其他进程写入数据库的修改。
+func watchConfig(h *handler.Handler, db *storage.DB, interval time.Duration) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	modTime := configModTime(h.Config().File)
+	for {
+		select {
+		case <-hup:
+			log.Println("Received SIGHUP, reloading config")
+			db.InvalidateConfig()
+			reloadConfig(h)
+			modTime = configModTime(h.Config().File)
+		case <-ticker.C:
+			file := h.Config().File
+			if file == "" {
+				continue
+			}
+			if t := configModTime(file); !t.Equal(modTime) {
+				modTime = t
+				log.Println("Config file changed, reloading")
+				reloadConfig(h)
+			}
+		}
+	}
+}
+
+func configModTime(path string) time.Time {
+	if path == "" {
+		return time.Time{}
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
+
+// reloadConfig 重新读取配置文件、环境变量和启动参数，校验通过后原子替换
+// 到 Handler 中；校验失败时保留当前配置。端口、上传目录、数据库路径、
+// 代理请求头无法在运行时替换，会保留旧值并提示重启；max_size 等运行时配置的
+// 初始值以数据库中的值为准，修改不会生效。
+func reloadConfig(h *handler.Handler) {
+	old := h.Config()
+
+	cfg, _, err := config.Load(configArgs)
+	if err == nil {
+		if _, err = cfg.ParseFlags(serveArgs); err == nil {
+			err = cfg.Validate()
+		}
+	}
+	if err != nil {
+		log.Println("Config reload failed, keeping current config:", err)
+		return
+	}
+
+	changes := config.Diff(old, cfg)
+	if len(changes) == 0 {
+		log.Println("Config reloaded, no changes")
+		return
+	}
+
+	// 变更本身记录在审计日志中，这里只提示没有生效的字段
+	applied := 0
+	for _, change := range changes {
+		h.Audit(handler.SystemActor, "", "config.reload", change.Field, change.Old, change.New)
+		switch {
+		case config.RequiresRestart(change.Field):
+			log.Printf("Config %s not applied (requires restart)", change)
+		case config.RuntimeSeed(change.Field):
+			log.Printf("Config %s not applied (runtime value in DB)", change)
+		default:
+			applied++
+		}
+	}
+	log.Printf("Config reloaded, %d of %d changes applied", applied, len(changes))
+
+	cfg.Port = old.Port
+	cfg.UploadDir = old.UploadDir
+	cfg.DBPath = old.DBPath
+	cfg.ProxyHeader = old.ProxyHeader
+	h.SetConfig(cfg)
+}
@@ -0,0 +1,103 @@
+package storage
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// AuditEntry 是一条修改操作的审计记录。Before / After 为操作前后的 JSON
+// 快照，不适用时为空。
+type AuditEntry struct {
+	ID        int64           `json:"id"`
+	Actor     string          `json:"actor"`
+	IP        string          `json:"ip"`
+	Action    string          `json:"action"`
+	Target    string          `json:"target"`
+	Before    json.RawMessage `json:"before,omitempty"`
+	After     json.RawMessage `json:"after,omitempty"`
+	CreatedAt time.Time       `json:"created_at"`
+}
+
+// AuditFilter 是审计日志的查询条件，零值字段不参与过滤
+type AuditFilter struct {
+	Actor  string
+	Action string
+	Target string
+	Since  time.Time
+	Until  time.Time
+	Limit  int
+	Offset int
+}
+
+func (db *DB) AddAudit(e *AuditEntry) error {
+	if e.CreatedAt.IsZero() {
+		e.CreatedAt = time.Now()
+	}
+	res, err := db.conn.Exec(
+		"INSERT INTO audit_log (actor, ip, action, target, before, after, created_at) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		e.Actor, e.IP, e.Action, e.Target, nullJSON(e.Before), nullJSON(e.After), e.CreatedAt,
+	)
+	if err != nil {
+		return err
+	}
+	e.ID, _ = res.LastInsertId()
+	return nil
+}
+
+// ListAudit 按时间倒序返回符合条件的审计记录
+func (db *DB) ListAudit(f AuditFilter) ([]AuditEntry, error) {
+	query := "SELECT id, actor, ip, action, target, COALESCE(before, ''), COALESCE(after, ''), created_at FROM audit_log WHERE 1 = 1"
+	args := []any{}
+	if f.Actor != "" {
+		query += " AND actor = ?"
+		args = append(args, f.Actor)
+	}
+	if f.Action != "" {
+		query += " AND action = ?"
+		args = append(args, f.Action)
+	}
+	if f.Target != "" {
+		query += " AND target = ?"
+		args = append(args, f.Target)
+	}
+	if !f.Since.IsZero() {
+		query += " AND created_at >= ?"
+		args = append(args, f.Since)
+	}
+	if !f.Until.IsZero() {
+		query += " AND created_at < ?"
+		args = append(args, f.Until)
+	}
+	query += " ORDER BY id DESC LIMIT ? OFFSET ?"
+	args = append(args, f.Limit, f.Offset)
+
+	rows, err := db.conn.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []AuditEntry
+	for rows.Next() {
+		var e AuditEntry
+		var before, after string
+		if err := rows.Scan(&e.ID, &e.Actor, &e.IP, &e.Action, &e.Target, &before, &after, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		if before != "" {
+			e.Before = json.RawMessage(before)
+		}
+		if after != "" {
+			e.After = json.RawMessage(after)
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+func nullJSON(v json.RawMessage) any {
+	if len(v) == 0 {
+		return nil
+	}
+	return string(v)
+}
@@ -0,0 +1,118 @@
+package storage
+
+import (
+	"time"
+)
+
+// AuthFailure 是一次失败的认证尝试
+type AuthFailure struct {
+	ID        int64     `json:"id"`
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"user_agent"`
+	Path      string    `json:"path"`
+	Reason    string    `json:"reason"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// IPBan 是对某个 IP 的临时封禁
+type IPBan struct {
+	IP        string    `json:"ip"`
+	Reason    string    `json:"reason"`
+	Until     time.Time `json:"until"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (db *DB) RecordAuthFailure(f *AuthFailure) error {
+	if f.CreatedAt.IsZero() {
+		f.CreatedAt = time.Now()
+	}
+	res, err := db.conn.Exec(
+		"INSERT INTO auth_failures (ip, user_agent, path, reason, created_at) VALUES (?, ?, ?, ?, ?)",
+		f.IP, f.UserAgent, f.Path, f.Reason, f.CreatedAt,
+	)
+	if err != nil {
+		return err
+	}
+	f.ID, _ = res.LastInsertId()
+	return nil
+}
+
+// CountAuthFailures 返回 ip 自 since 以来的失败次数
+func (db *DB) CountAuthFailures(ip string, since time.Time) (int64, error) {
+	var n int64
+	err := db.conn.QueryRow("SELECT COUNT(*) FROM auth_failures WHERE ip = ? AND created_at >= ?", ip, since).Scan(&n)
+	return n, err
+}
+
+// ListAuthFailures 按时间倒序返回失败记录，ip 非空时只返回该 IP 的记录
+func (db *DB) ListAuthFailures(ip string, limit, offset int) ([]AuthFailure, error) {
+	query := "SELECT id, ip, user_agent, path, reason, created_at FROM auth_failures"
+	args := []any{}
+	if ip != "" {
+		query += " WHERE ip = ?"
+		args = append(args, ip)
+	}
+	query += " ORDER BY id DESC LIMIT ? OFFSET ?"
+	args = append(args, limit, offset)
+
+	rows, err := db.conn.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var failures []AuthFailure
+	for rows.Next() {
+		var f AuthFailure
+		if err := rows.Scan(&f.ID, &f.IP, &f.UserAgent, &f.Path, &f.Reason, &f.CreatedAt); err != nil {
+			return nil, err
+		}
+		failures = append(failures, f)
+	}
+	return failures, rows.Err()
+}
+
+// PruneAuthFailures 删除 before 之前的失败记录
+func (db *DB) PruneAuthFailures(before time.Time) (int64, error) {
+	res, err := db.conn.Exec("DELETE FROM auth_failures WHERE created_at < ?", before)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// BanIP 封禁 ip 直到 ban.Until，已存在的封禁会被覆盖
+func (db *DB) BanIP(ban *IPBan) error {
+	if ban.CreatedAt.IsZero() {
+		ban.CreatedAt = time.Now()
+	}
+	_, err := db.conn.Exec(
+		"INSERT OR REPLACE INTO ip_bans (ip, reason, until, created_at) VALUES (?, ?, ?, ?)",
+		ban.IP, ban.Reason, ban.Until, ban.CreatedAt,
+	)
+	return err
+}
+
+func (db *DB) UnbanIP(ip string) error {
+	_, err := db.conn.Exec("DELETE FROM ip_bans WHERE ip = ?", ip)
+	return err
+}
+
+// ListBans 返回尚未到期的封禁
+func (db *DB) ListBans() ([]IPBan, error) {
+	rows, err := db.conn.Query("SELECT ip, reason, until, created_at FROM ip_bans WHERE until > ? ORDER BY until", time.Now())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var bans []IPBan
+	for rows.Next() {
+		var b IPBan
+		if err := rows.Scan(&b.IP, &b.Reason, &b.Until, &b.CreatedAt); err != nil {
+			return nil, err
+		}
+		bans = append(bans, b)
+	}
+	return bans, rows.Err()
+}
@@ -0,0 +1,298 @@
+package storage
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// 备份归档（tar.gz）中的条目名称。manifest 放在最后，
+// 这样可以边写边计算 hash，适合流式输出。
+const (
+	backupDBName       = "imgbed.db"
+	backupUploadsDir   = "uploads/"
+	backupManifestName = "manifest.json"
+	backupVersion      = 1
+)
+
+type BackupEntry struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+type BackupManifest struct {
+	Version   int           `json:"version"`
+	CreatedAt time.Time     `json:"created_at"`
+	Database  BackupEntry   `json:"database"`
+	Files     []BackupEntry `json:"files"`
+	Missing   []string      `json:"missing,omitempty"` // 快照中引用但备份时已不存在的文件
+}
+
+// Backup 将数据库的在线快照及其引用的所有文件写入 w（tar.gz 格式）。
+// 只归档快照中 blobs 表引用的文件，因此备份期间新增的上传不会出现在
+// 归档里，保证数据库与文件一致。
+func (db *DB) Backup(w io.Writer, uploadDir string) (*BackupManifest, error) {
+	snapshot, err := os.CreateTemp("", "imgbed-backup-*.db")
+	if err != nil {
+		return nil, err
+	}
+	snapshotPath := snapshot.Name()
+	snapshot.Close()
+	defer os.Remove(snapshotPath)
+
+	if err := db.snapshot(snapshotPath); err != nil {
+		return nil, fmt.Errorf("snapshot database: %w", err)
+	}
+
+	filenames, err := snapshotBlobFiles(snapshotPath)
+	if err != nil {
+		return nil, err
+	}
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+
+	manifest := &BackupManifest{Version: backupVersion, CreatedAt: time.Now().UTC(), Files: []BackupEntry{}}
+
+	manifest.Database, err = addFileToTar(tw, snapshotPath, backupDBName)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range filenames {
+		entry, err := addFileToTar(tw, filepath.Join(uploadDir, name), backupUploadsDir+name)
+		if errors.Is(err, os.ErrNotExist) {
+			manifest.Missing = append(manifest.Missing, name)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		manifest.Files = append(manifest.Files, entry)
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	hdr := &tar.Header{Name: backupManifestName, Mode: 0644, Size: int64(len(data)), ModTime: manifest.CreatedAt}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return nil, err
+	}
+	if _, err := tw.Write(data); err != nil {
+		return nil, err
+	}
+
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	return manifest, gz.Close()
+}
+
+// snapshot 使用 SQLite 在线备份 API 将当前数据库复制到 dest
+func (db *DB) snapshot(dest string) error {
+	ctx := context.Background()
+
+	destDB, err := sql.Open("sqlite3", dest)
+	if err != nil {
+		return err
+	}
+	defer destDB.Close()
+
+	destConn, err := destDB.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer destConn.Close()
+
+	srcConn, err := db.conn.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer srcConn.Close()
+
+	return destConn.Raw(func(d any) error {
+		return srcConn.Raw(func(s any) error {
+			destSQLite, ok := d.(*sqlite3.SQLiteConn)
+			srcSQLite, ok2 := s.(*sqlite3.SQLiteConn)
+			if !ok || !ok2 {
+				return errors.New("unexpected sqlite driver connection")
+			}
+
+			b, err := destSQLite.Backup("main", srcSQLite, "main")
+			if err != nil {
+				return err
+			}
+			if _, err := b.Step(-1); err != nil {
+				b.Finish()
+				return err
+			}
+			return b.Finish()
+		})
+	})
+}
+
+func snapshotBlobFiles(snapshotPath string) ([]string, error) {
+	conn, err := sql.Open("sqlite3", snapshotPath+"?mode=ro")
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	rows, err := conn.Query("SELECT filename FROM blobs ORDER BY filename")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
+
+func addFileToTar(tw *tar.Writer, src, name string) (BackupEntry, error) {
+	f, err := os.Open(src)
+	if err != nil {
+		return BackupEntry{}, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return BackupEntry{}, err
+	}
+
+	hdr := &tar.Header{Name: name, Mode: 0644, Size: info.Size(), ModTime: info.ModTime()}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return BackupEntry{}, err
+	}
+
+	hasher := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tw, hasher), f); err != nil {
+		return BackupEntry{}, err
+	}
+	return BackupEntry{Name: name, Size: info.Size(), SHA256: hex.EncodeToString(hasher.Sum(nil))}, nil
+}
+
+// Restore 从 Backup 生成的归档重建实例：先解压到临时目录并按 manifest
+// 校验所有文件，校验通过后再移动到 dbPath 和 uploadDir。dbPath 已存在时
+// 需要 force 才会覆盖。恢复期间不能有服务在使用该数据库。
+func Restore(r io.Reader, dbPath, uploadDir string, force bool) (*BackupManifest, error) {
+	if _, err := os.Stat(dbPath); err == nil && !force {
+		return nil, fmt.Errorf("%s already exists", dbPath)
+	}
+
+	if err := os.MkdirAll(uploadDir, 0755); err != nil {
+		return nil, err
+	}
+	staging, err := os.MkdirTemp(filepath.Dir(filepath.Clean(uploadDir)), ".imgbed-restore-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(staging)
+
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+
+	hashes := make(map[string]string)
+	var manifest *BackupManifest
+
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		name := path.Clean(hdr.Name)
+		if name == backupManifestName {
+			manifest = &BackupManifest{}
+			if err := json.NewDecoder(tr).Decode(manifest); err != nil {
+				return nil, fmt.Errorf("invalid manifest: %w", err)
+			}
+			continue
+		}
+
+		if name != backupDBName && (!strings.HasPrefix(name, backupUploadsDir) || strings.Contains(name[len(backupUploadsDir):], "/")) {
+			return nil, fmt.Errorf("unexpected archive entry: %s", hdr.Name)
+		}
+
+		dst := filepath.Join(staging, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			return nil, err
+		}
+		f, err := os.Create(dst)
+		if err != nil {
+			return nil, err
+		}
+		hasher := sha256.New()
+		_, err = io.Copy(io.MultiWriter(f, hasher), tr)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return nil, err
+		}
+		os.Chtimes(dst, hdr.ModTime, hdr.ModTime)
+		hashes[name] = hex.EncodeToString(hasher.Sum(nil))
+	}
+
+	if manifest == nil {
+		return nil, errors.New("archive has no manifest")
+	}
+	if manifest.Version != backupVersion {
+		return nil, fmt.Errorf("unsupported backup version %d", manifest.Version)
+	}
+
+	entries := append([]BackupEntry{manifest.Database}, manifest.Files...)
+	for _, entry := range entries {
+		if hashes[entry.Name] != entry.SHA256 {
+			return nil, fmt.Errorf("checksum mismatch for %s", entry.Name)
+		}
+	}
+
+	for _, entry := range manifest.Files {
+		name := strings.TrimPrefix(entry.Name, backupUploadsDir)
+		if err := moveFile(filepath.Join(staging, filepath.FromSlash(entry.Name)), filepath.Join(uploadDir, name)); err != nil {
+			return nil, err
+		}
+	}
+	if err := SyncDir(uploadDir); err != nil {
+		return nil, err
+	}
+
+	// 覆盖数据库前删除旧的 WAL 文件，避免其内容被重放到恢复的数据库上
+	os.Remove(dbPath + "-wal")
+	os.Remove(dbPath + "-shm")
+	if err := moveFile(filepath.Join(staging, backupDBName), dbPath); err != nil {
+		return nil, err
+	}
+	return manifest, SyncDir(filepath.Dir(dbPath))
+}
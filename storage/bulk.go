@@ -0,0 +1,125 @@
+package storage
+
+import (
+	"database/sql"
+	"time"
+)
+
+// 批量操作支持的动作
+const (
+	BulkDelete     = "delete"
+	BulkRestore    = "restore"
+	BulkVisibility = "visibility"
+	BulkTag        = "tag"
+	BulkAlbum      = "album"
+)
+
+// BulkRequest 描述一次批量操作
+type BulkRequest struct {
+	Action string
+	IDs    []string
+	// Owner 不为空时只允许操作该所有者的图片
+	Owner string
+	// Trash 为 true 时 delete 把图片移入回收站，否则彻底删除
+	Trash bool
+	// Visibility 是 visibility 动作设置的可见性
+	Visibility string
+	// Tags 是 tag 动作添加的标签，已有的标签保持不变
+	Tags []string
+	// Album 是 album 动作移入的相册，为空时移出相册
+	Album string
+}
+
+// BulkItem 是批量操作中单个图片的结果
+type BulkItem struct {
+	ID      string `json:"id"`
+	Success bool   `json:"success"`
+	Error   string `json:"error,omitempty"`
+	// Image 是操作前的图片记录，图片不存在时为 nil
+	Image *Image `json:"-"`
+}
+
+// Bulk 在同一事务中对 req.IDs 执行批量操作。单个图片不存在、无权操作或
+// 状态不符时记录在对应的 BulkItem 中，不影响其他图片；数据库出错时整批回滚。
+// 彻底删除后不再被引用的 blob 随结果返回，由调用方在提交后删除磁盘文件。
+func (db *DB) Bulk(req BulkRequest) ([]BulkItem, []*Blob, error) {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	items := make([]BulkItem, 0, len(req.IDs))
+	var orphans []*Blob
+	seen := make(map[string]bool, len(req.IDs))
+
+	for _, id := range req.IDs {
+		item := BulkItem{ID: id}
+		if seen[id] {
+			item.Error = "duplicate id"
+			items = append(items, item)
+			continue
+		}
+		seen[id] = true
+
+		img, err := scanImage(tx.QueryRow("SELECT "+imageColumns+" FROM "+imageFrom+" WHERE images.id = ?", id))
+		if err == sql.ErrNoRows {
+			item.Error = "image not found"
+			items = append(items, item)
+			continue
+		} else if err != nil {
+			return nil, nil, err
+		}
+		item.Image = img
+
+		switch {
+		case req.Owner != "" && img.Owner != req.Owner:
+			item.Error = "not the owner of this image"
+		case req.Action == BulkRestore && img.DeletedAt == nil:
+			item.Error = "image not in trash"
+		case req.Action != BulkRestore && img.DeletedAt != nil:
+			item.Error = "image not found"
+		}
+		if item.Error != "" {
+			items = append(items, item)
+			continue
+		}
+
+		switch req.Action {
+		case BulkDelete:
+			if req.Trash {
+				_, err = tx.Exec("UPDATE images SET deleted_at = ? WHERE id = ?", now, id)
+			} else {
+				var orphan *Blob
+				orphan, err = deleteImage(tx, id)
+				if orphan != nil {
+					orphans = append(orphans, orphan)
+				}
+			}
+		case BulkRestore:
+			_, err = tx.Exec("UPDATE images SET deleted_at = NULL WHERE id = ?", id)
+		case BulkVisibility:
+			_, err = tx.Exec("UPDATE images SET visibility = ? WHERE id = ?", req.Visibility, id)
+		case BulkTag:
+			for _, tag := range req.Tags {
+				if _, err = tx.Exec("INSERT OR IGNORE INTO image_tags (image_id, tag) VALUES (?, ?)", id, tag); err != nil {
+					break
+				}
+			}
+		case BulkAlbum:
+			_, err = tx.Exec("UPDATE images SET album = ? WHERE id = ?", req.Album, id)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+
+		item.Success = true
+		items = append(items, item)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, nil, err
+	}
+	return items, orphans, nil
+}
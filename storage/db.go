@@ -1,9 +1,17 @@
 package storage
 
 import (
+	"crypto/rand"
 	"database/sql"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	_ "github.com/mattn/go-sqlite3"
@@ -16,22 +24,97 @@ type Image struct {
 	Hash         string    `json:"hash"`
 	Size         int64     `json:"size"`
 	MimeType     string    `json:"mime_type"`
+	Width        int       `json:"width"`
+	Height       int       `json:"height"`
+	Owner        string    `json:"owner"`
+	Visibility   string    `json:"visibility"` // public, private
 	CreatedAt    time.Time `json:"created_at"`
+	// DeletedAt 不为空时图片位于回收站中，不再对外提供访问
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+	// ExpiresAt 不为空时图片在该时间之后失效，由后台任务删除
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	// Views 是图片被访问的次数，MaxViews 大于 0 时达到该次数后图片失效
+	Views    int64 `json:"views"`
+	MaxViews int64 `json:"max_views"`
+	// Album 是图片所在的相册，空字符串表示不属于任何相册
+	Album string   `json:"album"`
+	Tags  []string `json:"tags"`
+	// BlobHash 指向 blobs 表中实际存储的文件内容
+	BlobHash string `json:"-"`
+	// BlobFile 是 UploadDir 下实际存储的文件名
+	BlobFile string `json:"-"`
 }
 
+// Blob 是去重后实际落盘的文件内容，由一个或多个 Image 引用
+type Blob struct {
+	Hash       string    `json:"hash"`        // SHA256 of the stored (processed) bytes
+	SourceHash string    `json:"source_hash"` // SHA256 of the original upload
+	Filename   string    `json:"filename"`
+	Size       int64     `json:"size"`
+	MimeType   string    `json:"mime_type"`
+	PHash      string    `json:"phash"` // 64-bit dHash in hex, empty if not decodable
+	Width      int       `json:"width"`
+	Height     int       `json:"height"`
+	RefCount   int64     `json:"ref_count"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// Config 是可由管理员在运行时修改的配置，保存在 config 表中
 type Config struct {
-	EnableCompression bool  `json:"enable_compression"`
-	MaxWidth          int   `json:"max_width"`
-	JpegQuality       int   `json:"jpeg_quality"`
-	MaxSize           int64 `json:"max_size"` // in bytes
+	EnableCompression bool   `json:"enable_compression"`
+	MaxWidth          int    `json:"max_width"`
+	MaxHeight         int    `json:"max_height"` // 0 表示不限制
+	JpegQuality       int    `json:"jpeg_quality"`
+	PngCompression    string `json:"png_compression"` // default, none, speed, best
+	OutputFormat      string `json:"output_format"`   // original, jpeg, png
+	MaxSize           int64  `json:"max_size"`        // in bytes
+	// AllowedTypes 是允许上传的 MIME 类型，必须是 MimeExtensions 的子集
+	AllowedTypes      []string `json:"allowed_types"`
+	RetentionDays     int      `json:"retention_days"`     // 超过天数的图片自动删除（经过回收站），0 表示永久保留
+	DefaultVisibility string   `json:"default_visibility"` // public, private
+	// TrashRetentionDays 是删除的图片在回收站中保留的天数，0 表示删除时立即彻底删除
+	TrashRetentionDays int `json:"trash_retention_days"`
+	// 防盗链：开启后只有 HotlinkReferers 中的域名（支持 *.example.com）
+	// 可以引用公开图片，其他来源按 HotlinkAction 拒绝或返回占位图
+	HotlinkProtection bool     `json:"hotlink_protection"`
+	HotlinkReferers   []string `json:"hotlink_referers"`
+	HotlinkAllowEmpty bool     `json:"hotlink_allow_empty"` // 是否允许没有 Referer 的请求
+	HotlinkAction     string   `json:"hotlink_action"`      // forbid, placeholder
+}
+
+// 图片可见性：私有图片只能通过签名链接访问
+const (
+	VisibilityPublic  = "public"
+	VisibilityPrivate = "private"
+)
+
+// ErrBlobGone 表示 SaveImage 要沿用的已有 blob 在查询之后已被并发删除，
+// 其文件可能已不存在，调用方应改为写入新的文件
+var ErrBlobGone = errors.New("blob no longer exists")
+
+// MaxUploadSize 是 max_size 允许设置的最大值
+const MaxUploadSize = 100 * 1024 * 1024
+
+// MimeExtensions 是支持的图片类型及其保存时使用的扩展名
+var MimeExtensions = map[string]string{
+	"image/jpeg":    ".jpg",
+	"image/png":     ".png",
+	"image/gif":     ".gif",
+	"image/webp":    ".webp",
+	"image/svg+xml": ".svg",
 }
 
 type DB struct {
 	conn *sql.DB
+
+	// 运行时配置缓存：读取走 cfgCache 的原子指针，加载和更新由 cfgMu 串行化，
+	// 避免并发加载把旧值写回已失效的缓存
+	cfgCache atomic.Pointer[Config]
+	cfgMu    sync.Mutex
 }
 
 func NewDB(path string) (*DB, error) {
-	conn, err := sql.Open("sqlite3", path+"?_journal_mode=WAL")
+	conn, err := sql.Open("sqlite3", path+"?_journal_mode=WAL&_busy_timeout=5000")
 	if err != nil {
 		return nil, err
 	}
@@ -62,10 +145,89 @@ func (db *DB) migrate() error {
 	CREATE INDEX IF NOT EXISTS idx_created_at ON images(created_at DESC);
 	CREATE INDEX IF NOT EXISTS idx_hash ON images(hash);
 
+	CREATE TABLE IF NOT EXISTS blobs (
+		hash TEXT PRIMARY KEY,
+		source_hash TEXT DEFAULT '',
+		filename TEXT NOT NULL,
+		size INTEGER NOT NULL,
+		mime_type TEXT NOT NULL,
+		ref_count INTEGER NOT NULL DEFAULT 0,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS idx_blobs_source_hash ON blobs(source_hash);
+
+	CREATE TABLE IF NOT EXISTS image_tags (
+		image_id TEXT NOT NULL,
+		tag TEXT NOT NULL,
+		PRIMARY KEY (image_id, tag)
+	);
+	CREATE INDEX IF NOT EXISTS idx_image_tags_tag ON image_tags(tag);
+
 	CREATE TABLE IF NOT EXISTS config (
 		key TEXT PRIMARY KEY,
 		value TEXT NOT NULL
 	);
+
+	CREATE TABLE IF NOT EXISTS api_keys (
+		id TEXT PRIMARY KEY,
+		owner TEXT NOT NULL,
+		prefix TEXT NOT NULL,
+		key_hash TEXT NOT NULL UNIQUE,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE TABLE IF NOT EXISTS quotas (
+		owner TEXT PRIMARY KEY,
+		max_bytes INTEGER NOT NULL DEFAULT 0,
+		max_images INTEGER NOT NULL DEFAULT 0
+	);
+
+	CREATE TABLE IF NOT EXISTS hotlink_rules (
+		owner TEXT PRIMARY KEY,
+		protection INTEGER NOT NULL DEFAULT 0,
+		referers TEXT NOT NULL DEFAULT '',
+		allow_empty INTEGER NOT NULL DEFAULT 1,
+		action TEXT NOT NULL DEFAULT 'forbid'
+	);
+
+	CREATE TABLE IF NOT EXISTS auth_failures (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		ip TEXT NOT NULL,
+		user_agent TEXT DEFAULT '',
+		path TEXT DEFAULT '',
+		reason TEXT DEFAULT '',
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS idx_auth_failures_ip ON auth_failures(ip, created_at);
+
+	CREATE TABLE IF NOT EXISTS audit_log (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		actor TEXT NOT NULL,
+		ip TEXT DEFAULT '',
+		action TEXT NOT NULL,
+		target TEXT DEFAULT '',
+		before TEXT,
+		after TEXT,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS idx_audit_log_action ON audit_log(action);
+	CREATE INDEX IF NOT EXISTS idx_audit_log_target ON audit_log(target);
+
+	CREATE TABLE IF NOT EXISTS image_stats (
+		image_id TEXT NOT NULL,
+		day TEXT NOT NULL,
+		hits INTEGER NOT NULL DEFAULT 0,
+		bytes INTEGER NOT NULL DEFAULT 0,
+		PRIMARY KEY (image_id, day)
+	);
+	CREATE INDEX IF NOT EXISTS idx_image_stats_day ON image_stats(day);
+
+	CREATE TABLE IF NOT EXISTS ip_bans (
+		ip TEXT PRIMARY KEY,
+		reason TEXT DEFAULT '',
+		until DATETIME NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
 	`
 	_, err := db.conn.Exec(query)
 	if err != nil {
@@ -76,117 +238,766 @@ func (db *DB) migrate() error {
 	db.conn.Exec("ALTER TABLE images ADD COLUMN original_name TEXT DEFAULT ''")
 	// 添加 hash 列（如果不存在）
 	db.conn.Exec("ALTER TABLE images ADD COLUMN hash TEXT DEFAULT ''")
-
-	// 初始化默认配置（如果不存在）
-	db.initDefaultConfig()
+	// 添加 blob_hash / owner 列（如果不存在）
+	db.conn.Exec("ALTER TABLE images ADD COLUMN blob_hash TEXT DEFAULT ''")
+	db.conn.Exec("ALTER TABLE images ADD COLUMN owner TEXT DEFAULT ''")
+	// 添加可见性列（如果不存在）
+	db.conn.Exec("ALTER TABLE images ADD COLUMN visibility TEXT DEFAULT 'public'")
+	// 添加回收站删除时间列（如果不存在）
+	db.conn.Exec("ALTER TABLE images ADD COLUMN deleted_at DATETIME")
+	// 添加过期时间列（如果不存在）
+	db.conn.Exec("ALTER TABLE images ADD COLUMN expires_at DATETIME")
+	// 添加访问次数列（如果不存在）
+	db.conn.Exec("ALTER TABLE images ADD COLUMN views INTEGER DEFAULT 0")
+	db.conn.Exec("ALTER TABLE images ADD COLUMN max_views INTEGER DEFAULT 0")
+	// 添加相册列（如果不存在）
+	db.conn.Exec("ALTER TABLE images ADD COLUMN album TEXT DEFAULT ''")
+	db.conn.Exec("CREATE UNIQUE INDEX IF NOT EXISTS idx_images_filename ON images(filename)")
+	db.conn.Exec("CREATE INDEX IF NOT EXISTS idx_images_album ON images(album)")
+	db.conn.Exec("CREATE INDEX IF NOT EXISTS idx_images_blob_hash ON images(blob_hash)")
+	db.conn.Exec("CREATE INDEX IF NOT EXISTS idx_images_owner ON images(owner)")
+	db.conn.Exec("CREATE INDEX IF NOT EXISTS idx_images_deleted_at ON images(deleted_at)")
+	db.conn.Exec("CREATE INDEX IF NOT EXISTS idx_images_expires_at ON images(expires_at)")
+	// 添加 API 密钥默认有效期列（如果不存在）
+	db.conn.Exec("ALTER TABLE api_keys ADD COLUMN default_ttl TEXT DEFAULT ''")
+	// 添加感知哈希列（如果不存在）
+	db.conn.Exec("ALTER TABLE blobs ADD COLUMN phash TEXT DEFAULT ''")
+	// 添加尺寸列（如果不存在）
+	db.conn.Exec("ALTER TABLE blobs ADD COLUMN width INTEGER DEFAULT 0")
+	db.conn.Exec("ALTER TABLE blobs ADD COLUMN height INTEGER DEFAULT 0")
 
 	return nil
 }
 
-func (db *DB) SaveImage(img *Image) error {
-	_, err := db.conn.Exec(
-		"INSERT INTO images (id, filename, original_name, hash, size, mime_type, created_at) VALUES (?, ?, ?, ?, ?, ?, ?)",
-		img.ID, img.Filename, img.OriginalName, img.Hash, img.Size, img.MimeType, img.CreatedAt,
-	)
-	return err
+// MigrateBlobs 为旧版本（无 blobs 表）写入的图片创建对应的 blob 记录。
+// 旧记录的文件名即磁盘文件名，blob 以 uploadDir 中文件的实际内容 hash 为键，
+// 原有的 images.hash（压缩前的原始内容）保留为 source_hash。
+// 文件无法读取时退回以原 hash（或 id）为键，由 fsck 报告缺失的文件。
+func (db *DB) MigrateBlobs(uploadDir string) error {
+	rows, err := db.conn.Query(`
+	SELECT id, filename, COALESCE(hash, ''), size, mime_type, created_at
+	FROM images WHERE COALESCE(blob_hash, '') = ''`)
+	if err != nil {
+		return err
+	}
+
+	type legacy struct {
+		id, filename, hash, mimeType string
+		size                         int64
+		createdAt                    time.Time
+	}
+	var images []legacy
+	for rows.Next() {
+		var l legacy
+		if err := rows.Scan(&l.id, &l.filename, &l.hash, &l.size, &l.mimeType, &l.createdAt); err != nil {
+			rows.Close()
+			return err
+		}
+		images = append(images, l)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(images) == 0 {
+		return nil
+	}
+
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, l := range images {
+		key := l.hash
+		if key == "" {
+			key = l.id
+		}
+		size := l.size
+		path := filepath.Join(uploadDir, l.filename)
+		if sum, err := hashFile(path); err == nil {
+			key = sum
+			if info, err := os.Stat(path); err == nil {
+				size = info.Size()
+			}
+		}
+
+		_, err := tx.Exec(
+			"INSERT OR IGNORE INTO blobs (hash, source_hash, filename, size, mime_type, ref_count, created_at) VALUES (?, ?, ?, ?, ?, 0, ?)",
+			key, l.hash, l.filename, size, l.mimeType, l.createdAt,
+		)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec("UPDATE images SET blob_hash = ? WHERE id = ?", key, l.id); err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec("UPDATE blobs SET ref_count = (SELECT COUNT(*) FROM images WHERE images.blob_hash = blobs.hash)")
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
 }
 
-func (db *DB) GetImage(id string) (*Image, error) {
+const imageColumns = `images.id, images.filename, COALESCE(images.original_name, ''), COALESCE(images.hash, ''),
+	images.size, images.mime_type, COALESCE(blobs.width, 0), COALESCE(blobs.height, 0), COALESCE(images.owner, ''), COALESCE(images.visibility, 'public'), images.created_at,
+	images.deleted_at, images.expires_at, COALESCE(images.views, 0), COALESCE(images.max_views, 0), COALESCE(images.album, ''),
+	COALESCE((SELECT GROUP_CONCAT(tag) FROM image_tags WHERE image_tags.image_id = images.id), ''),
+	COALESCE(images.blob_hash, ''), COALESCE(blobs.filename, images.filename)`
+
+const imageFrom = "images LEFT JOIN blobs ON blobs.hash = images.blob_hash"
+
+// notDeleted 排除回收站中的图片
+const notDeleted = "images.deleted_at IS NULL"
+
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+// scanImage 扫描 imageColumns 对应的列，extra 接收查询中追加的列
+func scanImage(row scanner, extra ...any) (*Image, error) {
 	img := &Image{}
-	err := db.conn.QueryRow(
-		"SELECT id, filename, COALESCE(original_name, '') as original_name, COALESCE(hash, '') as hash, size, mime_type, created_at FROM images WHERE id = ?",
-		id,
-	).Scan(&img.ID, &img.Filename, &img.OriginalName, &img.Hash, &img.Size, &img.MimeType, &img.CreatedAt)
+	var tags string
+	dest := []any{&img.ID, &img.Filename, &img.OriginalName, &img.Hash, &img.Size, &img.MimeType,
+		&img.Width, &img.Height, &img.Owner, &img.Visibility, &img.CreatedAt, &img.DeletedAt, &img.ExpiresAt, &img.Views, &img.MaxViews,
+		&img.Album, &tags, &img.BlobHash, &img.BlobFile}
+	err := row.Scan(append(dest, extra...)...)
 	if err != nil {
 		return nil, err
 	}
+	img.Tags = splitList(tags)
+	if img.Tags == nil {
+		img.Tags = []string{}
+	}
 	return img, nil
 }
 
+// SaveImage 在同一事务中登记 blob（如不存在）、增加其引用计数并插入图片记录。
+// 若相同 hash 的 blob 已存在，blob 会被更新为已有记录。
+// blob 是从数据库查询到的已有记录（RefCount > 0）时只增加引用，
+// 若它在事务中已不存在则返回 ErrBlobGone，不做任何修改。
+// 写入会超出 img.Owner 的配额时返回 *QuotaError，不做任何修改。
+func (db *DB) SaveImage(img *Image, blob *Blob) error {
+	if img.Visibility == "" {
+		img.Visibility = VisibilityPublic
+	}
+
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if blob.RefCount > 0 {
+		// 查询与保存之间并发的 DeleteImage 可能已删除最后一个引用和文件，
+		// 此时不能重新创建指向缺失文件的 blob 记录
+		var refs int64
+		err := tx.QueryRow("SELECT ref_count FROM blobs WHERE hash = ?", blob.Hash).Scan(&refs)
+		if err == sql.ErrNoRows || (err == nil && refs <= 0) {
+			return ErrBlobGone
+		}
+		if err != nil {
+			return err
+		}
+	} else {
+		_, err = tx.Exec(
+			"INSERT OR IGNORE INTO blobs (hash, source_hash, filename, size, mime_type, phash, width, height, ref_count, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, 0, ?)",
+			blob.Hash, blob.SourceHash, blob.Filename, blob.Size, blob.MimeType, blob.PHash, blob.Width, blob.Height, img.CreatedAt,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	if _, err := tx.Exec("UPDATE blobs SET ref_count = ref_count + 1 WHERE hash = ?", blob.Hash); err != nil {
+		return err
+	}
+
+	stored, err := scanBlob(tx.QueryRow("SELECT "+blobColumns+" FROM blobs WHERE hash = ?", blob.Hash))
+	if err != nil {
+		return err
+	}
+	*blob = *stored
+
+	// 事务此时已持有写锁，并发上传无法同时通过配额检查
+	if err := checkQuota(tx, img.Owner, img.Size); err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(
+		"INSERT INTO images (id, filename, original_name, hash, size, mime_type, owner, visibility, blob_hash, created_at, expires_at, max_views) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		img.ID, img.Filename, img.OriginalName, img.Hash, img.Size, img.MimeType, img.Owner, img.Visibility, blob.Hash, img.CreatedAt, img.ExpiresAt, img.MaxViews,
+	)
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	img.BlobHash = blob.Hash
+	img.BlobFile = blob.Filename
+	img.Width = blob.Width
+	img.Height = blob.Height
+	return nil
+}
+
+// GetImage 按 ID 查找图片，包括回收站中的图片
+func (db *DB) GetImage(id string) (*Image, error) {
+	return scanImage(db.conn.QueryRow("SELECT "+imageColumns+" FROM "+imageFrom+" WHERE images.id = ?", id))
+}
+
+// GetImageByFilename 按公开文件名（/i/:filename）查找图片，回收站中的图片视为不存在
+func (db *DB) GetImageByFilename(filename string) (*Image, error) {
+	return scanImage(db.conn.QueryRow("SELECT "+imageColumns+" FROM "+imageFrom+" WHERE images.filename = ? AND "+notDeleted, filename))
+}
+
 func (db *DB) GetImageByHash(hash string) (*Image, error) {
-	img := &Image{}
-	err := db.conn.QueryRow(
-		"SELECT id, filename, COALESCE(original_name, '') as original_name, COALESCE(hash, '') as hash, size, mime_type, created_at FROM images WHERE hash = ? LIMIT 1",
-		hash,
-	).Scan(&img.ID, &img.Filename, &img.OriginalName, &img.Hash, &img.Size, &img.MimeType, &img.CreatedAt)
+	return scanImage(db.conn.QueryRow("SELECT "+imageColumns+" FROM "+imageFrom+" WHERE images.hash = ? LIMIT 1", hash))
+}
+
+// ImageFilter 是 ListImages 的过滤和分页条件，空字段表示不过滤
+type ImageFilter struct {
+	Owner  string
+	Tag    string
+	Album  string
+	Limit  int
+	Offset int
+}
+
+// ListImages 按上传时间倒序返回回收站以外符合条件的图片
+func (db *DB) ListImages(f ImageFilter) ([]Image, error) {
+	query := "SELECT " + imageColumns + " FROM " + imageFrom + " WHERE " + notDeleted
+	args := []any{}
+	if f.Owner != "" {
+		query += " AND images.owner = ?"
+		args = append(args, f.Owner)
+	}
+	if f.Tag != "" {
+		query += " AND EXISTS (SELECT 1 FROM image_tags WHERE image_tags.image_id = images.id AND image_tags.tag = ?)"
+		args = append(args, f.Tag)
+	}
+	if f.Album != "" {
+		query += " AND images.album = ?"
+		args = append(args, f.Album)
+	}
+	query += " ORDER BY images.created_at DESC LIMIT ? OFFSET ?"
+	args = append(args, f.Limit, f.Offset)
+
+	rows, err := db.conn.Query(query, args...)
 	if err != nil {
 		return nil, err
 	}
-	return img, nil
+	defer rows.Close()
+
+	var images []Image
+	for rows.Next() {
+		img, err := scanImage(rows)
+		if err != nil {
+			return nil, err
+		}
+		images = append(images, *img)
+	}
+	return images, rows.Err()
+}
+
+// EachImage 按上传时间倒序逐行遍历回收站以外的所有图片，不会把整张表读入内存。
+// fn 返回错误时停止遍历并返回该错误。
+func (db *DB) EachImage(fn func(img *Image) error) error {
+	rows, err := db.conn.Query("SELECT " + imageColumns + " FROM " + imageFrom + " WHERE " + notDeleted + " ORDER BY images.created_at DESC")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		img, err := scanImage(rows)
+		if err != nil {
+			return err
+		}
+		if err := fn(img); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// DeleteImage 彻底删除图片记录（无论是否在回收站中）并减少 blob 引用计数。
+// 当 blob 不再被任何图片引用时同时删除 blob 记录并将其返回，
+// 由调用方负责删除磁盘文件；否则返回 nil。
+func (db *DB) DeleteImage(id string) (*Blob, error) {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	orphan, err := deleteImage(tx, id)
+	if err != nil {
+		return nil, err
+	}
+	return orphan, tx.Commit()
+}
+
+// deleteImage 在事务 tx 中执行 DeleteImage
+func deleteImage(tx *sql.Tx, id string) (*Blob, error) {
+	var blobHash string
+	if err := tx.QueryRow("SELECT COALESCE(blob_hash, '') FROM images WHERE id = ?", id).Scan(&blobHash); err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.Exec("DELETE FROM images WHERE id = ?", id); err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.Exec("DELETE FROM image_stats WHERE image_id = ?", id); err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.Exec("DELETE FROM image_tags WHERE image_id = ?", id); err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.Exec("UPDATE blobs SET ref_count = ref_count - 1 WHERE hash = ?", blobHash); err != nil {
+		return nil, err
+	}
+
+	blob, err := scanBlob(tx.QueryRow("SELECT "+blobColumns+" FROM blobs WHERE hash = ?", blobHash))
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	var orphan *Blob
+	if err == nil && blob.RefCount <= 0 {
+		if _, err := tx.Exec("DELETE FROM blobs WHERE hash = ?", blobHash); err != nil {
+			return nil, err
+		}
+		orphan = blob
+	}
+
+	return orphan, nil
+}
+
+const blobColumns = "hash, COALESCE(source_hash, ''), filename, size, mime_type, COALESCE(phash, ''), COALESCE(width, 0), COALESCE(height, 0), ref_count, created_at"
+
+func scanBlob(row scanner) (*Blob, error) {
+	blob := &Blob{}
+	err := row.Scan(&blob.Hash, &blob.SourceHash, &blob.Filename, &blob.Size, &blob.MimeType, &blob.PHash,
+		&blob.Width, &blob.Height, &blob.RefCount, &blob.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return blob, nil
+}
+
+func (db *DB) getBlob(where string, arg string) (*Blob, error) {
+	return scanBlob(db.conn.QueryRow("SELECT "+blobColumns+" FROM blobs WHERE "+where+" LIMIT 1", arg))
+}
+
+// GetBlob 按存储内容的 hash 查找 blob
+func (db *DB) GetBlob(hash string) (*Blob, error) {
+	return db.getBlob("hash = ?", hash)
+}
+
+// GetBlobBySourceHash 按原始上传内容的 hash 查找 blob
+func (db *DB) GetBlobBySourceHash(hash string) (*Blob, error) {
+	return db.getBlob("source_hash = ?", hash)
+}
+
+// ImagesCreatedBefore 返回创建时间早于 t 且不在回收站中的图片 ID，最多 limit 个
+func (db *DB) ImagesCreatedBefore(t time.Time, limit int) ([]string, error) {
+	rows, err := db.conn.Query("SELECT id FROM images WHERE created_at < ? AND deleted_at IS NULL ORDER BY created_at LIMIT ?", t, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
 }
 
-func (db *DB) ListImages(limit, offset int) ([]Image, error) {
+// ExpiredImages 返回在 now 时已过期（expires_at）或访问次数已达到 max_views
+// 的图片 ID，最多 limit 个
+func (db *DB) ExpiredImages(now time.Time, limit int) ([]string, error) {
 	rows, err := db.conn.Query(
-		"SELECT id, filename, COALESCE(original_name, '') as original_name, COALESCE(hash, '') as hash, size, mime_type, created_at FROM images ORDER BY created_at DESC LIMIT ? OFFSET ?",
-		limit, offset,
+		"SELECT id FROM images WHERE expires_at < ? OR (max_views > 0 AND views >= max_views) LIMIT ?",
+		now, limit,
 	)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	var images []Image
+	var ids []string
 	for rows.Next() {
-		var img Image
-		if err := rows.Scan(&img.ID, &img.Filename, &img.OriginalName, &img.Hash, &img.Size, &img.MimeType, &img.CreatedAt); err != nil {
+		var id string
+		if err := rows.Scan(&id); err != nil {
 			return nil, err
 		}
-		images = append(images, img)
+		ids = append(ids, id)
 	}
-	return images, nil
+	return ids, rows.Err()
 }
 
-func (db *DB) DeleteImage(id string) error {
-	_, err := db.conn.Exec("DELETE FROM images WHERE id = ?", id)
-	return err
+// SetVisibility 修改图片的可见性。图片不存在或在回收站中时返回 sql.ErrNoRows。
+func (db *DB) SetVisibility(id, visibility string) error {
+	res, err := db.conn.Exec("UPDATE images SET visibility = ? WHERE id = ? AND deleted_at IS NULL", visibility, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// RecordView 原子地增加限制访问次数的图片的访问次数。图片未设置 max_views
+// 或已达到上限时不做修改并返回 false；不限制次数的图片的访问次数由
+// AddImageStats 批量写入。
+func (db *DB) RecordView(id string) (bool, error) {
+	res, err := db.conn.Exec("UPDATE images SET views = views + 1 WHERE id = ? AND max_views > 0 AND views < max_views", id)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
 }
 
 func (db *DB) Count() (int64, error) {
 	var count int64
-	err := db.conn.QueryRow("SELECT COUNT(*) FROM images").Scan(&count)
+	err := db.conn.QueryRow("SELECT COUNT(*) FROM images WHERE deleted_at IS NULL").Scan(&count)
 	return count, err
 }
 
+// TotalSize 返回去重后实际占用的磁盘空间
 func (db *DB) TotalSize() (int64, error) {
 	var size sql.NullInt64
-	err := db.conn.QueryRow("SELECT SUM(size) FROM images").Scan(&size)
+	err := db.conn.QueryRow("SELECT SUM(size) FROM blobs").Scan(&size)
 	if err != nil {
 		return 0, err
 	}
 	return size.Int64, nil
 }
 
+// NewID 生成 12 位十六进制的随机 ID
+func NewID() string {
+	b := make([]byte, 6)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
 func (db *DB) Close() error {
 	return db.conn.Close()
 }
 
 // Config methods
-func (db *DB) initDefaultConfig() {
-	defaults := map[string]string{
-		"enable_compression": "true",
-		"max_width":          "1920",
-		"jpeg_quality":       "85",
-		"max_size":           "52428800", // 50MB in bytes
+
+// DefaultConfig 返回运行时配置的内置默认值
+func DefaultConfig() *Config {
+	return &Config{
+		EnableCompression:  true,
+		MaxWidth:           1920,
+		MaxHeight:          0,
+		JpegQuality:        85,
+		PngCompression:     "default",
+		OutputFormat:       "original",
+		MaxSize:            50 * 1024 * 1024, // 50MB
+		AllowedTypes:       []string{"image/jpeg", "image/png", "image/gif", "image/webp", "image/svg+xml"},
+		RetentionDays:      0,
+		DefaultVisibility:  VisibilityPublic,
+		TrashRetentionDays: 30,
+		HotlinkProtection:  false,
+		HotlinkReferers:    []string{},
+		HotlinkAllowEmpty:  true,
+		HotlinkAction:      "forbid",
 	}
+}
+
+// values 返回配置在 config 表中的键值表示
+func (cfg *Config) values() map[string]string {
+	return map[string]string{
+		"enable_compression":   strconv.FormatBool(cfg.EnableCompression),
+		"max_width":            strconv.Itoa(cfg.MaxWidth),
+		"max_height":           strconv.Itoa(cfg.MaxHeight),
+		"jpeg_quality":         strconv.Itoa(cfg.JpegQuality),
+		"png_compression":      cfg.PngCompression,
+		"output_format":        cfg.OutputFormat,
+		"max_size":             strconv.FormatInt(cfg.MaxSize, 10),
+		"allowed_types":        strings.Join(cfg.AllowedTypes, ","),
+		"retention_days":       strconv.Itoa(cfg.RetentionDays),
+		"default_visibility":   cfg.DefaultVisibility,
+		"trash_retention_days": strconv.Itoa(cfg.TrashRetentionDays),
+		"hotlink_protection":   strconv.FormatBool(cfg.HotlinkProtection),
+		"hotlink_referers":     strings.Join(cfg.HotlinkReferers, ","),
+		"hotlink_allow_empty":  strconv.FormatBool(cfg.HotlinkAllowEmpty),
+		"hotlink_action":       cfg.HotlinkAction,
+	}
+}
+
+// SeedConfig 将 defaults 写入 config 表中尚不存在的键。
+// 已存在的运行时配置不会被覆盖。
+func (db *DB) SeedConfig(defaults *Config) error {
+	db.cfgMu.Lock()
+	defer db.cfgMu.Unlock()
+	defer db.cfgCache.Store(nil)
 
-	for key, value := range defaults {
-		db.conn.Exec("INSERT OR IGNORE INTO config (key, value) VALUES (?, ?)", key, value)
+	for key, value := range defaults.values() {
+		if _, err := db.conn.Exec("INSERT OR IGNORE INTO config (key, value) VALUES (?, ?)", key, value); err != nil {
+			return err
+		}
 	}
+	return nil
 }
 
+// Set 按配置表中的键名设置一项配置，值使用与配置表相同的字符串格式
+func (cfg *Config) Set(key, value string) error {
+	invalid := fmt.Errorf("invalid value for %s: %q", key, value)
+
+	switch key {
+	case "enable_compression", "hotlink_protection", "hotlink_allow_empty":
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return invalid
+		}
+		switch key {
+		case "enable_compression":
+			cfg.EnableCompression = b
+		case "hotlink_protection":
+			cfg.HotlinkProtection = b
+		case "hotlink_allow_empty":
+			cfg.HotlinkAllowEmpty = b
+		}
+	case "max_width", "max_height", "jpeg_quality", "retention_days", "trash_retention_days":
+		v, err := strconv.Atoi(value)
+		if err != nil {
+			return invalid
+		}
+		switch key {
+		case "max_width":
+			cfg.MaxWidth = v
+		case "max_height":
+			cfg.MaxHeight = v
+		case "jpeg_quality":
+			cfg.JpegQuality = v
+		case "retention_days":
+			cfg.RetentionDays = v
+		case "trash_retention_days":
+			cfg.TrashRetentionDays = v
+		}
+	case "max_size":
+		v, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return invalid
+		}
+		cfg.MaxSize = v
+	case "png_compression":
+		cfg.PngCompression = value
+	case "output_format":
+		cfg.OutputFormat = value
+	case "default_visibility":
+		cfg.DefaultVisibility = value
+	case "hotlink_action":
+		cfg.HotlinkAction = value
+	case "allowed_types":
+		cfg.AllowedTypes = splitList(value)
+	case "hotlink_referers":
+		cfg.HotlinkReferers = splitList(value)
+		if cfg.HotlinkReferers == nil {
+			cfg.HotlinkReferers = []string{}
+		}
+	default:
+		return fmt.Errorf("unknown config key: %s", key)
+	}
+	return nil
+}
+
+// Validate 检查运行时配置的取值范围
+func (cfg *Config) Validate() error {
+	if cfg.MaxWidth < 100 || cfg.MaxWidth > 10000 {
+		return errors.New("max_width must be between 100 and 10000")
+	}
+
+	if cfg.MaxHeight != 0 && (cfg.MaxHeight < 100 || cfg.MaxHeight > 10000) {
+		return errors.New("max_height must be 0 (unlimited) or between 100 and 10000")
+	}
+
+	if cfg.JpegQuality < 1 || cfg.JpegQuality > 100 {
+		return errors.New("jpeg_quality must be between 1 and 100")
+	}
+
+	switch cfg.PngCompression {
+	case "default", "none", "speed", "best":
+	default:
+		return errors.New("png_compression must be one of default, none, speed, best")
+	}
+
+	switch cfg.OutputFormat {
+	case "original", "jpeg", "png":
+	default:
+		return errors.New("output_format must be one of original, jpeg, png")
+	}
+
+	if cfg.MaxSize < 1024*1024 || cfg.MaxSize > MaxUploadSize {
+		return errors.New("max_size must be between 1MB and 100MB")
+	}
+
+	if len(cfg.AllowedTypes) == 0 {
+		return errors.New("allowed_types must not be empty")
+	}
+	for _, t := range cfg.AllowedTypes {
+		if _, ok := MimeExtensions[t]; !ok {
+			return fmt.Errorf("allowed_types: unsupported type %q", t)
+		}
+	}
+
+	if cfg.RetentionDays < 0 || cfg.RetentionDays > 36500 {
+		return errors.New("retention_days must be between 0 and 36500")
+	}
+
+	if cfg.DefaultVisibility != VisibilityPublic && cfg.DefaultVisibility != VisibilityPrivate {
+		return errors.New("default_visibility must be public or private")
+	}
+
+	if cfg.TrashRetentionDays < 0 || cfg.TrashRetentionDays > 3650 {
+		return errors.New("trash_retention_days must be between 0 and 3650")
+	}
+
+	for _, r := range cfg.HotlinkReferers {
+		if !validRefererPattern(r) {
+			return fmt.Errorf("hotlink_referers: invalid domain %q", r)
+		}
+	}
+
+	switch cfg.HotlinkAction {
+	case "forbid", "placeholder":
+	default:
+		return errors.New("hotlink_action must be forbid or placeholder")
+	}
+
+	return nil
+}
+
+// splitList 解析配置表中以逗号分隔的列表，忽略空项
+func splitList(value string) []string {
+	var list []string
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+// validRefererPattern 检查防盗链白名单项：域名或 *. 开头的通配域名，
+// 不含协议、端口和路径
+func validRefererPattern(pattern string) bool {
+	host := strings.TrimPrefix(pattern, "*.")
+	if host == "" || strings.ContainsAny(host, "*:/?# ,") {
+		return false
+	}
+	return true
+}
+
+// AllowsReferer 报告来源主机名 host 是否在防盗链白名单中。
+// "*.example.com" 匹配 example.com 的所有子域名，但不匹配 example.com 本身。
+func (cfg *Config) AllowsReferer(host string) bool {
+	host = strings.ToLower(host)
+	for _, pattern := range cfg.HotlinkReferers {
+		pattern = strings.ToLower(pattern)
+		if suffix, ok := strings.CutPrefix(pattern, "*"); ok {
+			if strings.HasSuffix(host, suffix) {
+				return true
+			}
+		} else if host == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// Allows 报告 mimeType 是否允许上传
+func (cfg *Config) Allows(mimeType string) bool {
+	for _, t := range cfg.AllowedTypes {
+		if t == mimeType {
+			return true
+		}
+	}
+	return false
+}
+
+// OutputType 返回压缩后保存的 MIME 类型。GIF 和 SVG 不做转换，
+// 以保留动画和矢量格式。
+func (cfg *Config) OutputType(mimeType string) string {
+	if mimeType == "image/gif" || mimeType == "image/svg+xml" {
+		return mimeType
+	}
+	switch cfg.OutputFormat {
+	case "jpeg":
+		return "image/jpeg"
+	case "png":
+		return "image/png"
+	}
+	return mimeType
+}
+
+// clone 返回配置的副本，调用方可以随意修改而不影响缓存
+func (cfg *Config) clone() *Config {
+	c := *cfg
+	c.AllowedTypes = append([]string(nil), cfg.AllowedTypes...)
+	c.HotlinkReferers = append([]string{}, cfg.HotlinkReferers...)
+	return &c
+}
+
+// GetConfig 返回运行时配置。配置在首次读取时从 config 表加载并缓存在内存中，
+// 之后的读取不再访问数据库，直到 UpdateConfig、SeedConfig 或 InvalidateConfig。
 func (db *DB) GetConfig() (*Config, error) {
+	if cfg := db.cfgCache.Load(); cfg != nil {
+		return cfg.clone(), nil
+	}
+
+	db.cfgMu.Lock()
+	defer db.cfgMu.Unlock()
+
+	// 等待锁期间可能已被其他请求加载
+	if cfg := db.cfgCache.Load(); cfg != nil {
+		return cfg.clone(), nil
+	}
+
+	cfg, err := db.loadConfig()
+	if err != nil {
+		return nil, err
+	}
+	db.cfgCache.Store(cfg)
+	return cfg.clone(), nil
+}
+
+// InvalidateConfig 丢弃缓存的运行时配置，下次读取时重新从数据库加载。
+// 用于其他进程（例如本地的 `imgbed config set`）修改了配置表之后。
+func (db *DB) InvalidateConfig() {
+	db.cfgMu.Lock()
+	defer db.cfgMu.Unlock()
+	db.cfgCache.Store(nil)
+}
+
+func (db *DB) loadConfig() (*Config, error) {
 	rows, err := db.conn.Query("SELECT key, value FROM config")
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	cfg := &Config{
-		EnableCompression: true,
-		MaxWidth:          1920,
-		JpegQuality:       85,
-		MaxSize:           50 * 1024 * 1024, // 50MB
-	}
+	cfg := DefaultConfig()
 
 	for rows.Next() {
 		var key, value string
@@ -194,51 +1005,32 @@ func (db *DB) GetConfig() (*Config, error) {
 			continue
 		}
 
-		switch key {
-		case "enable_compression":
-			cfg.EnableCompression = value == "true"
-		case "max_width":
-			if v, err := strconv.Atoi(value); err == nil {
-				cfg.MaxWidth = v
-			}
-		case "jpeg_quality":
-			if v, err := strconv.Atoi(value); err == nil {
-				cfg.JpegQuality = v
-			}
-		case "max_size":
-			if v, err := strconv.ParseInt(value, 10, 64); err == nil {
-				cfg.MaxSize = v
-			}
-		}
+		cfg.Set(key, value)
 	}
 
 	return cfg, nil
 }
 
 func (db *DB) UpdateConfig(cfg *Config) error {
+	db.cfgMu.Lock()
+	defer db.cfgMu.Unlock()
+
 	tx, err := db.conn.Begin()
 	if err != nil {
 		return err
 	}
 	defer tx.Rollback()
 
-	updates := map[string]string{
-		"enable_compression": "false",
-		"max_width":          fmt.Sprintf("%d", cfg.MaxWidth),
-		"jpeg_quality":       fmt.Sprintf("%d", cfg.JpegQuality),
-		"max_size":           fmt.Sprintf("%d", cfg.MaxSize),
-	}
-
-	if cfg.EnableCompression {
-		updates["enable_compression"] = "true"
-	}
-
-	for key, value := range updates {
+	for key, value := range cfg.values() {
 		_, err := tx.Exec("INSERT OR REPLACE INTO config (key, value) VALUES (?, ?)", key, value)
 		if err != nil {
 			return err
 		}
 	}
 
-	return tx.Commit()
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	db.cfgCache.Store(cfg.clone())
+	return nil
 }
@@ -0,0 +1,96 @@
+package storage
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// TempPrefix 是写入过程中临时文件的前缀。临时文件只有在 fsync 并
+// rename 到最终文件名后才算写入完成，启动时残留的临时文件会被清理。
+const TempPrefix = ".tmp_"
+
+// CommitFile 将 tmpPath 刷盘后原子地 rename 为 dstPath，并刷新所在目录，
+// 保证进程崩溃或断电后 dstPath 要么不存在，要么内容完整。
+func CommitFile(tmpPath, dstPath string) error {
+	f, err := os.OpenFile(tmpPath, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmpPath, dstPath); err != nil {
+		return err
+	}
+	return SyncDir(filepath.Dir(dstPath))
+}
+
+// moveFile 将 src 移动到 dst；跨文件系统时退化为复制后删除
+func moveFile(src, dst string) error {
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	tmp := filepath.Join(filepath.Dir(dst), TempPrefix+filepath.Base(dst))
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := CommitFile(tmp, dst); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Remove(src)
+}
+
+// SyncDir 刷新目录项，使 rename/创建操作持久化
+func SyncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// CleanTempFiles 删除 dir 中残留的临时文件，返回删除的数量。
+// 只应在没有上传进行时调用（例如服务启动时）。
+func CleanTempFiles(dir string) (int, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasPrefix(e.Name(), TempPrefix) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, e.Name())); err == nil {
+			removed++
+		}
+	}
+	return removed, nil
+}
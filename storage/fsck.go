@@ -0,0 +1,368 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"mime"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Fsck 问题类型
+const (
+	IssueOrphanFile       = "orphan_file"       // 磁盘上有文件但没有 blob 记录
+	IssueMissingFile      = "missing_file"      // blob 记录对应的文件不存在
+	IssueDanglingImage    = "dangling_image"    // 图片记录引用了不存在的 blob
+	IssueSizeMismatch     = "size_mismatch"     // 记录的大小与文件大小不符
+	IssueHashMismatch     = "hash_mismatch"     // 记录的 hash 与文件内容不符
+	IssueRefCountMismatch = "refcount_mismatch" // 引用计数与实际图片数不符
+)
+
+// FsckOptions 控制 Fsck 是否修复发现的问题；全部为 false 时只检查不修改
+type FsckOptions struct {
+	ImportOrphans   bool `json:"import_orphans"`   // 为孤立文件创建 blob 和图片记录
+	RemoveDangling  bool `json:"remove_dangling"`  // 删除指向缺失文件/blob 的记录并修正引用计数
+	RecomputeHashes bool `json:"recompute_hashes"` // 按文件内容更新 hash 和大小
+}
+
+// orphanMinAge 是孤立文件可以被导入的最小时长。上传先写入文件再提交记录，
+// 在线运行 fsck 时较新的无记录文件可能属于进行中的上传，导入会与其争用
+// 图片 ID 并导致上传失败时删除已被导入记录引用的文件。
+const orphanMinAge = 10 * time.Minute
+
+type FsckIssue struct {
+	Kind     string `json:"kind"`
+	Filename string `json:"filename,omitempty"`
+	ImageID  string `json:"image_id,omitempty"`
+	Hash     string `json:"hash,omitempty"`
+	Detail   string `json:"detail,omitempty"`
+	Repaired bool   `json:"repaired"`
+}
+
+type FsckReport struct {
+	FilesScanned int         `json:"files_scanned"`
+	BlobsScanned int         `json:"blobs_scanned"`
+	Issues       []FsckIssue `json:"issues"`
+}
+
+// Unresolved 返回未修复的问题数量
+func (r *FsckReport) Unresolved() int {
+	n := 0
+	for _, issue := range r.Issues {
+		if !issue.Repaired {
+			n++
+		}
+	}
+	return n
+}
+
+// Fsck 对比 uploadDir 中的文件与 blobs/images 表，报告并按 opts 修复不一致
+func (db *DB) Fsck(uploadDir string, opts FsckOptions) (*FsckReport, error) {
+	report := &FsckReport{Issues: []FsckIssue{}}
+
+	entries, err := os.ReadDir(uploadDir)
+	if err != nil {
+		return nil, err
+	}
+	files := make(map[string]os.FileInfo)
+	for _, e := range entries {
+		if e.IsDir() || strings.HasPrefix(e.Name(), TempPrefix) {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		files[e.Name()] = info
+	}
+	report.FilesScanned = len(files)
+
+	blobs, err := db.allBlobs()
+	if err != nil {
+		return nil, err
+	}
+	report.BlobsScanned = len(blobs)
+
+	known := make(map[string]bool)
+	for _, blob := range blobs {
+		known[blob.Filename] = true
+
+		info, ok := files[blob.Filename]
+		if !ok {
+			issue := FsckIssue{Kind: IssueMissingFile, Filename: blob.Filename, Hash: blob.Hash}
+			if opts.RemoveDangling {
+				issue.Repaired = db.removeBlob(blob.Hash) == nil
+			}
+			report.Issues = append(report.Issues, issue)
+			continue
+		}
+
+		if info.Size() != blob.Size {
+			issue := FsckIssue{
+				Kind:     IssueSizeMismatch,
+				Filename: blob.Filename,
+				Hash:     blob.Hash,
+				Detail:   formatSizes(blob.Size, info.Size()),
+			}
+			if opts.RecomputeHashes {
+				_, err := db.conn.Exec("UPDATE blobs SET size = ? WHERE hash = ?", info.Size(), blob.Hash)
+				if err == nil {
+					_, err = db.conn.Exec("UPDATE images SET size = ? WHERE blob_hash = ?", info.Size(), blob.Hash)
+				}
+				issue.Repaired = err == nil
+			}
+			report.Issues = append(report.Issues, issue)
+		}
+
+		sum, err := hashFile(filepath.Join(uploadDir, blob.Filename))
+		if err != nil {
+			return nil, err
+		}
+		if sum != blob.Hash {
+			issue := FsckIssue{Kind: IssueHashMismatch, Filename: blob.Filename, Hash: blob.Hash, Detail: "actual " + sum}
+			if opts.RecomputeHashes {
+				issue.Repaired = db.rehashBlob(uploadDir, blob, sum) == nil
+			}
+			report.Issues = append(report.Issues, issue)
+		}
+	}
+
+	for name, info := range files {
+		if known[name] {
+			continue
+		}
+		issue := FsckIssue{Kind: IssueOrphanFile, Filename: name}
+		if time.Since(info.ModTime()) < orphanMinAge {
+			issue.Detail = "modified within " + orphanMinAge.String() + ", possibly an upload in progress"
+		} else if opts.ImportOrphans {
+			issue.Repaired = db.importOrphan(uploadDir, name, info) == nil
+		}
+		report.Issues = append(report.Issues, issue)
+	}
+
+	dangling, err := db.danglingImages()
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range dangling {
+		issue := FsckIssue{Kind: IssueDanglingImage, ImageID: id}
+		if opts.RemoveDangling {
+			issue.Repaired = db.removeDanglingImage(id) == nil
+		}
+		report.Issues = append(report.Issues, issue)
+	}
+
+	rows, err := db.conn.Query(`
+	SELECT blobs.hash, blobs.ref_count, (SELECT COUNT(*) FROM images WHERE images.blob_hash = blobs.hash) AS refs
+	FROM blobs WHERE blobs.ref_count != refs`)
+	if err != nil {
+		return nil, err
+	}
+	var mismatched []FsckIssue
+	for rows.Next() {
+		var hash string
+		var stored, actual int64
+		if err := rows.Scan(&hash, &stored, &actual); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		mismatched = append(mismatched, FsckIssue{Kind: IssueRefCountMismatch, Hash: hash, Detail: formatSizes(stored, actual)})
+	}
+	rows.Close()
+	for _, issue := range mismatched {
+		if opts.RemoveDangling {
+			_, err := db.conn.Exec("UPDATE blobs SET ref_count = (SELECT COUNT(*) FROM images WHERE images.blob_hash = blobs.hash) WHERE hash = ?", issue.Hash)
+			issue.Repaired = err == nil
+		}
+		report.Issues = append(report.Issues, issue)
+	}
+
+	return report, nil
+}
+
+func (db *DB) allBlobs() ([]Blob, error) {
+	rows, err := db.conn.Query("SELECT " + blobColumns + " FROM blobs")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var blobs []Blob
+	for rows.Next() {
+		blob, err := scanBlob(rows)
+		if err != nil {
+			return nil, err
+		}
+		blobs = append(blobs, *blob)
+	}
+	return blobs, rows.Err()
+}
+
+func (db *DB) danglingImages() ([]string, error) {
+	rows, err := db.conn.Query("SELECT id FROM images WHERE NOT EXISTS (SELECT 1 FROM blobs WHERE blobs.hash = images.blob_hash)")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// removeBlob 删除 blob 及所有引用它的图片记录，连同这些图片的标签和访问统计
+func (db *DB) removeBlob(hash string) error {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, table := range []string{"image_tags", "image_stats"} {
+		if _, err := tx.Exec("DELETE FROM "+table+" WHERE image_id IN (SELECT id FROM images WHERE blob_hash = ?)", hash); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec("DELETE FROM images WHERE blob_hash = ?", hash); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM blobs WHERE hash = ?", hash); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// removeDanglingImage 删除指向不存在的 blob 的图片记录。与普通删除走同一
+// 流程，图片的标签和访问统计一并删除。
+func (db *DB) removeDanglingImage(id string) error {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := deleteImage(tx, id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// rehashBlob 将 blob 的主键更新为文件的实际 hash。若该 hash 已被另一个 blob
+// 占用，则把引用合并过去并删除多余的文件。
+func (db *DB) rehashBlob(uploadDir string, blob Blob, sum string) error {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	existing, err := scanBlob(tx.QueryRow("SELECT "+blobColumns+" FROM blobs WHERE hash = ?", sum))
+	if err == nil {
+		if _, err := tx.Exec("UPDATE images SET blob_hash = ? WHERE blob_hash = ?", sum, blob.Hash); err != nil {
+			return err
+		}
+		if _, err := tx.Exec("UPDATE blobs SET ref_count = ref_count + ? WHERE hash = ?", blob.RefCount, sum); err != nil {
+			return err
+		}
+		if _, err := tx.Exec("DELETE FROM blobs WHERE hash = ?", blob.Hash); err != nil {
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		if existing.Filename != blob.Filename {
+			os.Remove(filepath.Join(uploadDir, blob.Filename))
+		}
+		return nil
+	}
+
+	if _, err := tx.Exec("UPDATE blobs SET hash = ? WHERE hash = ?", sum, blob.Hash); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("UPDATE images SET blob_hash = ? WHERE blob_hash = ?", sum, blob.Hash); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// importOrphan 为没有记录的文件创建 blob 和图片记录
+func (db *DB) importOrphan(uploadDir, name string, info os.FileInfo) error {
+	ext := filepath.Ext(name)
+	mimeType := mime.TypeByExtension(strings.ToLower(ext))
+	if i := strings.Index(mimeType, ";"); i >= 0 {
+		mimeType = mimeType[:i]
+	}
+	if !strings.HasPrefix(mimeType, "image/") {
+		return os.ErrInvalid
+	}
+
+	sum, err := hashFile(filepath.Join(uploadDir, name))
+	if err != nil {
+		return err
+	}
+
+	id := strings.TrimSuffix(name, ext)
+	if _, err := db.GetImage(id); err == nil || id == "" {
+		id = NewID()
+	}
+
+	blob := &Blob{
+		Hash:       sum,
+		SourceHash: sum,
+		Filename:   name,
+		Size:       info.Size(),
+		MimeType:   mimeType,
+	}
+	if f, err := os.Open(filepath.Join(uploadDir, name)); err == nil {
+		if cfg, _, err := image.DecodeConfig(f); err == nil {
+			blob.Width, blob.Height = cfg.Width, cfg.Height
+		}
+		f.Close()
+	}
+	img := &Image{
+		ID:           id,
+		Filename:     name,
+		OriginalName: name,
+		Hash:         sum,
+		Size:         info.Size(),
+		MimeType:     mimeType,
+		CreatedAt:    info.ModTime(),
+	}
+	if _, err := db.GetImageByFilename(name); err == nil {
+		// 公开文件名已被占用，使用新的文件名
+		img.Filename = id + ext
+	}
+	return db.SaveImage(img, blob)
+}
+
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+func formatSizes(recorded, actual int64) string {
+	return fmt.Sprintf("recorded %d, actual %d", recorded, actual)
+}
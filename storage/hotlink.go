@@ -0,0 +1,78 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// HotlinkRule 为某个所有者的公开图片单独设置防盗链，整体替代运行时配置中的
+// hotlink_protection、hotlink_referers、hotlink_allow_empty 和 hotlink_action
+type HotlinkRule struct {
+	Owner      string   `json:"owner"`
+	Protection bool     `json:"hotlink_protection"`
+	Referers   []string `json:"hotlink_referers"`
+	AllowEmpty bool     `json:"hotlink_allow_empty"`
+	Action     string   `json:"hotlink_action"` // forbid, placeholder
+}
+
+// Validate 检查规则的取值，与运行时配置中对应项的规则相同
+func (r *HotlinkRule) Validate() error {
+	for _, ref := range r.Referers {
+		if !validRefererPattern(ref) {
+			return fmt.Errorf("hotlink_referers: invalid domain %q", ref)
+		}
+	}
+
+	switch r.Action {
+	case "forbid", "placeholder":
+	default:
+		return errors.New("hotlink_action must be forbid or placeholder")
+	}
+	return nil
+}
+
+// Apply 用规则覆盖 cfg 中的防盗链设置
+func (r *HotlinkRule) Apply(cfg *Config) {
+	cfg.HotlinkProtection = r.Protection
+	cfg.HotlinkReferers = append([]string{}, r.Referers...)
+	cfg.HotlinkAllowEmpty = r.AllowEmpty
+	cfg.HotlinkAction = r.Action
+}
+
+// ListHotlinkRules 按所有者返回所有防盗链规则
+func (db *DB) ListHotlinkRules() ([]HotlinkRule, error) {
+	rows, err := db.conn.Query("SELECT owner, protection, referers, allow_empty, action FROM hotlink_rules ORDER BY owner")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rules []HotlinkRule
+	for rows.Next() {
+		var r HotlinkRule
+		var referers string
+		if err := rows.Scan(&r.Owner, &r.Protection, &referers, &r.AllowEmpty, &r.Action); err != nil {
+			return nil, err
+		}
+		r.Referers = splitList(referers)
+		if r.Referers == nil {
+			r.Referers = []string{}
+		}
+		rules = append(rules, r)
+	}
+	return rules, rows.Err()
+}
+
+func (db *DB) SetHotlinkRule(r *HotlinkRule) error {
+	_, err := db.conn.Exec(
+		"INSERT OR REPLACE INTO hotlink_rules (owner, protection, referers, allow_empty, action) VALUES (?, ?, ?, ?, ?)",
+		r.Owner, r.Protection, strings.Join(r.Referers, ","), r.AllowEmpty, r.Action,
+	)
+	return err
+}
+
+func (db *DB) DeleteHotlinkRule(owner string) error {
+	_, err := db.conn.Exec("DELETE FROM hotlink_rules WHERE owner = ?", owner)
+	return err
+}
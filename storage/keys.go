@@ -0,0 +1,109 @@
+package storage
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"time"
+)
+
+// APIKey 是分配给用户的上传密钥。密钥本身只在创建时返回一次，
+// 数据库中只保存其 SHA256。
+type APIKey struct {
+	ID     string `json:"id"`
+	Owner  string `json:"owner"`  // 通过该密钥上传的图片记录的所有者
+	Prefix string `json:"prefix"` // 密钥开头几位，便于识别
+	// DefaultTTL 是通过该密钥上传、且未指定 ttl 的图片的有效期（如 24h），空表示永久
+	DefaultTTL string    `json:"default_ttl"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// APIKeyPrefix 是所有 API 密钥的固定前缀
+const APIKeyPrefix = "ik_"
+
+const apiKeyColumns = "id, owner, prefix, COALESCE(default_ttl, ''), created_at"
+
+// CreateAPIKey 为 owner 生成新的 API 密钥，返回记录和明文密钥
+func (db *DB) CreateAPIKey(owner, defaultTTL string) (*APIKey, string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return nil, "", err
+	}
+	secret := APIKeyPrefix + hex.EncodeToString(b)
+
+	key := &APIKey{
+		ID:         NewID(),
+		Owner:      owner,
+		Prefix:     secret[:len(APIKeyPrefix)+6],
+		DefaultTTL: defaultTTL,
+		CreatedAt:  time.Now(),
+	}
+	_, err := db.conn.Exec(
+		"INSERT INTO api_keys (id, owner, prefix, key_hash, default_ttl, created_at) VALUES (?, ?, ?, ?, ?, ?)",
+		key.ID, key.Owner, key.Prefix, hashKey(secret), key.DefaultTTL, key.CreatedAt,
+	)
+	if err != nil {
+		return nil, "", err
+	}
+	return key, secret, nil
+}
+
+// GetAPIKey 按明文密钥查找记录
+func (db *DB) GetAPIKey(secret string) (*APIKey, error) {
+	key := &APIKey{}
+	err := db.conn.QueryRow(
+		"SELECT "+apiKeyColumns+" FROM api_keys WHERE key_hash = ?", hashKey(secret),
+	).Scan(&key.ID, &key.Owner, &key.Prefix, &key.DefaultTTL, &key.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func (db *DB) ListAPIKeys() ([]APIKey, error) {
+	rows, err := db.conn.Query("SELECT " + apiKeyColumns + " FROM api_keys ORDER BY created_at")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []APIKey
+	for rows.Next() {
+		var key APIKey
+		if err := rows.Scan(&key.ID, &key.Owner, &key.Prefix, &key.DefaultTTL, &key.CreatedAt); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+// GetAPIKeyByID 按 ID 查找密钥记录
+func (db *DB) GetAPIKeyByID(id string) (*APIKey, error) {
+	key := &APIKey{}
+	err := db.conn.QueryRow(
+		"SELECT "+apiKeyColumns+" FROM api_keys WHERE id = ?", id,
+	).Scan(&key.ID, &key.Owner, &key.Prefix, &key.DefaultTTL, &key.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// DeleteAPIKey 吊销密钥，已上传的图片不受影响
+func (db *DB) DeleteAPIKey(id string) error {
+	res, err := db.conn.Exec("DELETE FROM api_keys WHERE id = ?", id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func hashKey(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,130 @@
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// Quota 限制某个所有者可以使用的存储空间和图片数量，0 表示不限制
+type Quota struct {
+	Owner     string `json:"owner"`
+	MaxBytes  int64  `json:"max_bytes"`
+	MaxImages int64  `json:"max_images"`
+}
+
+// Usage 是某个所有者当前的图片数量和占用空间（按每张图片的大小计算，
+// 去重共享的内容对每个引用者都计入）
+type Usage struct {
+	Images int64 `json:"images"`
+	Bytes  int64 `json:"bytes"`
+}
+
+// QuotaUsage 是配额及其当前使用量
+type QuotaUsage struct {
+	Quota
+	Usage Usage `json:"usage"`
+}
+
+// QuotaError 表示写入会超出所有者的配额
+type QuotaError struct {
+	Quota Quota
+	Usage Usage
+}
+
+func (e *QuotaError) Error() string {
+	if e.Quota.MaxImages > 0 && e.Usage.Images >= e.Quota.MaxImages {
+		return fmt.Sprintf("image quota exceeded (%d of %d images)", e.Usage.Images, e.Quota.MaxImages)
+	}
+	return fmt.Sprintf("storage quota exceeded (%d of %d bytes used)", e.Usage.Bytes, e.Quota.MaxBytes)
+}
+
+// queryer 是 *sql.DB 和 *sql.Tx 共有的查询方法
+type queryer interface {
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+// GetQuota 返回 owner 的配额，未设置时返回 nil
+func (db *DB) GetQuota(owner string) (*Quota, error) {
+	return getQuota(db.conn, owner)
+}
+
+func getQuota(q queryer, owner string) (*Quota, error) {
+	quota := &Quota{Owner: owner}
+	err := q.QueryRow("SELECT max_bytes, max_images FROM quotas WHERE owner = ?", owner).Scan(&quota.MaxBytes, &quota.MaxImages)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return quota, nil
+}
+
+// GetUsage 返回 owner 当前的使用量
+func (db *DB) GetUsage(owner string) (Usage, error) {
+	return getUsage(db.conn, owner)
+}
+
+func getUsage(q queryer, owner string) (Usage, error) {
+	var u Usage
+	err := q.QueryRow("SELECT COUNT(*), COALESCE(SUM(size), 0) FROM images WHERE owner = ?", owner).Scan(&u.Images, &u.Bytes)
+	return u, err
+}
+
+// CheckQuota 检查 owner 再写入 size 字节的一张图片是否会超出配额，
+// 超出时返回 *QuotaError
+func (db *DB) CheckQuota(owner string, size int64) error {
+	return checkQuota(db.conn, owner, size)
+}
+
+func checkQuota(q queryer, owner string, size int64) error {
+	quota, err := getQuota(q, owner)
+	if err != nil || quota == nil {
+		return err
+	}
+
+	usage, err := getUsage(q, owner)
+	if err != nil {
+		return err
+	}
+	if (quota.MaxImages > 0 && usage.Images+1 > quota.MaxImages) ||
+		(quota.MaxBytes > 0 && usage.Bytes+size > quota.MaxBytes) {
+		return &QuotaError{Quota: *quota, Usage: usage}
+	}
+	return nil
+}
+
+func (db *DB) SetQuota(q *Quota) error {
+	_, err := db.conn.Exec(
+		"INSERT OR REPLACE INTO quotas (owner, max_bytes, max_images) VALUES (?, ?, ?)",
+		q.Owner, q.MaxBytes, q.MaxImages,
+	)
+	return err
+}
+
+func (db *DB) DeleteQuota(owner string) error {
+	_, err := db.conn.Exec("DELETE FROM quotas WHERE owner = ?", owner)
+	return err
+}
+
+// ListQuotas 返回所有配额及其当前使用量
+func (db *DB) ListQuotas() ([]QuotaUsage, error) {
+	rows, err := db.conn.Query(`
+	SELECT quotas.owner, quotas.max_bytes, quotas.max_images, COUNT(images.id), COALESCE(SUM(images.size), 0)
+	FROM quotas LEFT JOIN images ON images.owner = quotas.owner
+	GROUP BY quotas.owner ORDER BY quotas.owner`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var quotas []QuotaUsage
+	for rows.Next() {
+		var q QuotaUsage
+		if err := rows.Scan(&q.Owner, &q.MaxBytes, &q.MaxImages, &q.Usage.Images, &q.Usage.Bytes); err != nil {
+			return nil, err
+		}
+		quotas = append(quotas, q)
+	}
+	return quotas, rows.Err()
+}
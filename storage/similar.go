@@ -0,0 +1,66 @@
+package storage
+
+import (
+	"math/bits"
+	"sort"
+	"strconv"
+)
+
+// SimilarImage 是相似图片查询的结果，Distance 为感知哈希的汉明距离（0-64）
+type SimilarImage struct {
+	Image
+	Distance int `json:"distance"`
+}
+
+// HammingDistance 计算两个十六进制感知哈希之间的汉明距离
+func HammingDistance(a, b string) (int, bool) {
+	x, err := strconv.ParseUint(a, 16, 64)
+	if err != nil {
+		return 0, false
+	}
+	y, err := strconv.ParseUint(b, 16, 64)
+	if err != nil {
+		return 0, false
+	}
+	return bits.OnesCount64(x ^ y), true
+}
+
+// FindSimilar 返回感知哈希与 phash 距离不超过 maxDistance 的图片，
+// 按距离升序排列。excludeID 对应的图片不会出现在结果中，owner 不为空时
+// 只在该所有者的图片中查找。
+func (db *DB) FindSimilar(phash string, maxDistance, limit int, excludeID, owner string) ([]SimilarImage, error) {
+	rows, err := db.conn.Query(
+		"SELECT "+imageColumns+", blobs.phash FROM "+imageFrom+" WHERE COALESCE(blobs.phash, '') != '' AND images.id != ? AND (? = '' OR images.owner = ?) AND "+notDeleted,
+		excludeID, owner, owner,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var results []SimilarImage
+	for rows.Next() {
+		var other string
+		img, err := scanImage(rows, &other)
+		if err != nil {
+			return nil, err
+		}
+
+		d, ok := HammingDistance(phash, other)
+		if !ok || d > maxDistance {
+			continue
+		}
+		results = append(results, SimilarImage{Image: *img, Distance: d})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].Distance < results[j].Distance
+	})
+	if limit > 0 && len(results) > limit {
+		results = results[:limit]
+	}
+	return results, nil
+}
@@ -0,0 +1,140 @@
+package storage
+
+import (
+	"time"
+)
+
+// StatsKey 标识一张图片在某一天（UTC，格式 2006-01-02）的访问统计
+type StatsKey struct {
+	ImageID string
+	Day     string
+}
+
+// StatsDelta 是一段时间内累计的访问增量。Views 是需要加到 images.views 上的
+// 次数，不包括已经由 RecordView 原子计数的访问。
+type StatsDelta struct {
+	Hits  int64
+	Bytes int64
+	Views int64
+}
+
+// DailyStats 是一张图片一天的访问统计
+type DailyStats struct {
+	Day   string `json:"day"`
+	Hits  int64  `json:"hits"`
+	Bytes int64  `json:"bytes"`
+}
+
+// TopImage 是访问排行中的一项
+type TopImage struct {
+	Image
+	Hits  int64 `json:"hits"`
+	Bytes int64 `json:"bytes"`
+}
+
+// StatsDay 返回 t 所在的统计日
+func StatsDay(t time.Time) string {
+	return t.UTC().Format("2006-01-02")
+}
+
+// AddImageStats 在一个事务中把内存中累计的访问增量写入 image_stats，并更新
+// images.views。已被彻底删除的图片会被忽略。
+func (db *DB) AddImageStats(deltas map[StatsKey]StatsDelta) error {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for key, d := range deltas {
+		_, err := tx.Exec(`
+		INSERT INTO image_stats (image_id, day, hits, bytes)
+		SELECT ?, ?, ?, ? WHERE EXISTS (SELECT 1 FROM images WHERE id = ?)
+		ON CONFLICT(image_id, day) DO UPDATE SET hits = hits + excluded.hits, bytes = bytes + excluded.bytes`,
+			key.ImageID, key.Day, d.Hits, d.Bytes, key.ImageID,
+		)
+		if err != nil {
+			return err
+		}
+
+		if d.Views > 0 {
+			if _, err := tx.Exec("UPDATE images SET views = views + ? WHERE id = ?", d.Views, key.ImageID); err != nil {
+				return err
+			}
+		}
+	}
+
+	return tx.Commit()
+}
+
+// ImageStats 返回图片从 since（含）开始每天的访问统计，按日期升序排列
+func (db *DB) ImageStats(id string, since string) ([]DailyStats, error) {
+	rows, err := db.conn.Query(
+		"SELECT day, hits, bytes FROM image_stats WHERE image_id = ? AND day >= ? ORDER BY day",
+		id, since,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var stats []DailyStats
+	for rows.Next() {
+		var s DailyStats
+		if err := rows.Scan(&s.Day, &s.Hits, &s.Bytes); err != nil {
+			return nil, err
+		}
+		stats = append(stats, s)
+	}
+	return stats, rows.Err()
+}
+
+// TopImages 返回从 since（含）开始访问次数（orderBy 为 "bytes" 时按流量）
+// 最多的图片，owner 不为空时只统计该所有者的图片。回收站中的图片不参与排行。
+func (db *DB) TopImages(owner, since, orderBy string, limit int) ([]TopImage, error) {
+	order := "hits"
+	if orderBy == "bytes" {
+		order = "bytes"
+	}
+
+	rows, err := db.conn.Query(`
+	SELECT `+imageColumns+`, s.hits, s.bytes
+	FROM `+imageFrom+`
+	JOIN (SELECT image_id, SUM(hits) AS hits, SUM(bytes) AS bytes FROM image_stats WHERE day >= ? GROUP BY image_id) s
+		ON s.image_id = images.id
+	WHERE `+notDeleted+` AND (? = '' OR images.owner = ?)
+	ORDER BY s.`+order+` DESC LIMIT ?`,
+		since, owner, owner, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var top []TopImage
+	for rows.Next() {
+		var t TopImage
+		img, err := scanImage(rows, &t.Hits, &t.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		t.Image = *img
+		top = append(top, t)
+	}
+	return top, rows.Err()
+}
+
+// TotalServed 返回所有图片累计的访问次数和流量
+func (db *DB) TotalServed() (hits, bytes int64, err error) {
+	err = db.conn.QueryRow("SELECT COALESCE(SUM(hits), 0), COALESCE(SUM(bytes), 0) FROM image_stats").Scan(&hits, &bytes)
+	return hits, bytes, err
+}
+
+// PruneImageStats 删除早于 before 的每日统计，返回删除的行数
+func (db *DB) PruneImageStats(before string) (int64, error) {
+	res, err := db.conn.Exec("DELETE FROM image_stats WHERE day < ?", before)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
@@ -0,0 +1,72 @@
+package storage
+
+import (
+	"database/sql"
+	"time"
+)
+
+// TrashImage 把图片移入回收站。文件和 blob 引用保持不变，直到图片被恢复
+// 或彻底删除。图片不存在或已在回收站中时返回 sql.ErrNoRows。
+func (db *DB) TrashImage(id string) error {
+	res, err := db.conn.Exec("UPDATE images SET deleted_at = ? WHERE id = ? AND deleted_at IS NULL", time.Now(), id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// RestoreImage 把回收站中的图片恢复。图片不在回收站中时返回 sql.ErrNoRows。
+func (db *DB) RestoreImage(id string) error {
+	res, err := db.conn.Exec("UPDATE images SET deleted_at = NULL WHERE id = ? AND deleted_at IS NOT NULL", id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// ListTrash 按删除时间倒序返回回收站中的图片，owner 为空时返回所有所有者的图片
+func (db *DB) ListTrash(owner string, limit, offset int) ([]Image, error) {
+	rows, err := db.conn.Query(
+		"SELECT "+imageColumns+" FROM "+imageFrom+" WHERE images.deleted_at IS NOT NULL AND (? = '' OR images.owner = ?) ORDER BY images.deleted_at DESC LIMIT ? OFFSET ?",
+		owner, owner, limit, offset,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var images []Image
+	for rows.Next() {
+		img, err := scanImage(rows)
+		if err != nil {
+			return nil, err
+		}
+		images = append(images, *img)
+	}
+	return images, rows.Err()
+}
+
+// TrashedBefore 返回删除时间早于 t 的回收站图片 ID，最多 limit 个
+func (db *DB) TrashedBefore(t time.Time, limit int) ([]string, error) {
+	rows, err := db.conn.Query("SELECT id FROM images WHERE deleted_at < ? ORDER BY deleted_at LIMIT ?", t, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
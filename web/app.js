@@ -46,6 +46,7 @@
     const infoDate = $('infoDate');
     const infoDimensions = $('infoDimensions');
     const infoHash = $('infoHash');
+    const infoVisibility = $('infoVisibility');
     const urlDirect = $('urlDirect');
     const urlMarkdown = $('urlMarkdown');
     const urlHtml = $('urlHtml');
@@ -53,6 +54,7 @@
     const copyDefault = $('copyDefault');
     const deleteImage = $('deleteImage');
     const viewImage = $('viewImage');
+    const toggleVisibility = $('toggleVisibility');
 
     // Image viewer
     const imageViewer = $('imageViewer');
@@ -353,7 +355,7 @@
 
             card.innerHTML = `
                 <div class="thumb">
-                    <img src="/i/${img.filename}" alt="${displayName}" loading="lazy">
+                    <img src="${previewUrl(img)}" alt="${displayName}" loading="lazy">
                     <div class="quick-actions">
                         <button class="quick-action-btn" data-action="copy-url" title="复制直链">
                             <svg width="16" height="16" viewBox="0 0 24 24" fill="none" stroke="currentColor" stroke-width="2">
@@ -409,6 +411,17 @@
         loadMore.style.display = offset >= filteredImages.length ? 'none' : 'block';
     }
 
+    // 私有图片的直链无法访问，使用图片列表返回的签名链接
+    function imageUrl(img) {
+        return img.signed_url || window.location.origin + '/i/' + img.filename;
+    }
+
+    // 限制访问次数的图片使用不计入访问次数的预览链接显示，
+    // 复制的链接仍然是 imageUrl
+    function previewUrl(img) {
+        return img.preview_url || imageUrl(img);
+    }
+
     function handleCardClick(img, card) {
         if (selectMode) {
             toggleSelection(img.id, card);
@@ -419,7 +432,7 @@
 
     // Quick action handler
     async function handleQuickAction(action, img) {
-        const url = window.location.origin + '/i/' + img.filename;
+        const url = imageUrl(img);
         const displayName = img.original_name || img.filename;
 
         switch (action) {
@@ -475,8 +488,7 @@
     function openImageViewer() {
         if (!currentImage) return;
 
-        const url = window.location.origin + '/i/' + currentImage.filename;
-        viewerImage.src = url;
+        viewerImage.src = previewUrl(currentImage);
         imageViewer.classList.add('active');
         resetViewerState();
         updateViewerTransform();
@@ -525,6 +537,7 @@
 
     // Image viewer event listeners
     viewImage.onclick = openImageViewer;
+    toggleVisibility.onclick = toggleCurrentVisibility;
     viewerClose.onclick = closeImageViewer;
     viewerZoomIn.onclick = zoomIn;
     viewerZoomOut.onclick = zoomOut;
@@ -647,22 +660,30 @@
         let successCount = 0;
         let failCount = 0;
 
-        for (const id of selectedIds) {
-            try {
-                const res = await fetch('/api/images/' + id, {
-                    method: 'DELETE',
-                    headers: { 'Authorization': 'Bearer ' + token }
-                });
+        try {
+            const res = await fetch('/api/images/bulk', {
+                method: 'POST',
+                headers: {
+                    'Authorization': 'Bearer ' + token,
+                    'Content-Type': 'application/json'
+                },
+                body: JSON.stringify({ action: 'delete', ids: [...selectedIds] })
+            });
 
-                if (res.ok) {
-                    successCount++;
-                    allImages = allImages.filter(img => img.id !== id);
-                } else {
-                    failCount++;
-                }
-            } catch (e) {
-                failCount++;
+            if (res.ok) {
+                const data = await res.json();
+                const deleted = new Set();
+                data.results.forEach(item => {
+                    if (item.success) deleted.add(item.id);
+                });
+                successCount = data.succeeded;
+                failCount = data.failed;
+                allImages = allImages.filter(img => !deleted.has(img.id));
+            } else {
+                failCount = count;
             }
+        } catch (e) {
+            failCount = count;
         }
 
         selectedIds.clear();
@@ -817,10 +838,10 @@
     function openImageModal(img) {
         currentImage = img;
 
-        const url = window.location.origin + '/i/' + img.filename;
+        const url = imageUrl(img);
         const displayName = img.original_name || img.filename;
 
-        modalImage.src = url;
+        modalImage.src = previewUrl(img);
         modalImage.onload = function() {
             infoDimensions.textContent = `${this.naturalWidth} x ${this.naturalHeight}`;
         };
@@ -829,6 +850,8 @@
         infoSize.textContent = formatSize(img.size);
         infoDate.textContent = formatFullDate(img.created_at);
         infoHash.textContent = img.hash || 'N/A';
+        infoVisibility.textContent = img.visibility === 'private' ? '私有' : '公开';
+        toggleVisibility.querySelector('span').textContent = img.visibility === 'private' ? '设为公开' : '设为私有';
 
         urlDirect.value = url;
         urlMarkdown.value = `![${displayName}](${url})`;
@@ -840,7 +863,7 @@
 
     function getFormattedUrl() {
         if (!currentImage) return '';
-        const url = window.location.origin + '/i/' + currentImage.filename;
+        const url = imageUrl(currentImage);
         const displayName = currentImage.original_name || currentImage.filename;
         const format = getDefaultFormat();
 
@@ -886,6 +909,39 @@
         }
     }
 
+    async function toggleCurrentVisibility() {
+        if (!currentImage) return;
+
+        const token = getToken();
+        if (!token) {
+            showToast('请先配置认证令牌');
+            return;
+        }
+
+        const visibility = currentImage.visibility === 'private' ? 'public' : 'private';
+        try {
+            const res = await fetch('/api/images/' + currentImage.id + '/visibility', {
+                method: 'PUT',
+                headers: {
+                    'Authorization': 'Bearer ' + token,
+                    'Content-Type': 'application/json'
+                },
+                body: JSON.stringify({ visibility })
+            });
+
+            if (res.ok) {
+                showToast(visibility === 'private' ? '已设为私有' : '已设为公开');
+                imageModal.classList.remove('active');
+                loadAllImages();
+            } else {
+                const data = await res.json();
+                showToast('修改失败: ' + data.error);
+            }
+        } catch (e) {
+            showToast('修改失败');
+        }
+    }
+
     // Event listeners
 
     // Upload